@@ -0,0 +1,267 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/hmac"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// adminPassword enables the admin API when set
+var adminPassword = ""
+
+// ChannelInfo describes a channel for the admin API
+type ChannelInfo struct {
+	Name string
+	ChannelMeta
+	Locked      bool
+	Muted       bool
+	Publisher   *PublisherInfo `json:",omitempty"`
+	Standby     *PublisherInfo `json:",omitempty"`
+	Subscribers []SubscriberInfo
+	AudioLevel  *AudioLevel `json:",omitempty"`
+}
+
+type PublisherInfo struct {
+	ID          string
+	Addr        string
+	ConnectedAt time.Time
+	ICEState    string
+	// Disconnected is set while the channel is held open for the publisher to reconnect
+	Disconnected bool
+	// Talkback is set while an operator is talking to the publisher
+	Talkback bool
+}
+
+type SubscriberInfo struct {
+	ID          string
+	Addr        string
+	ConnectedAt time.Time
+	ICEState    string
+}
+
+func newPublisherInfo(p *Publisher) *PublisherInfo {
+	if p == nil {
+		return nil
+	}
+	return &PublisherInfo{ID: p.ID, Addr: p.Addr, ConnectedAt: p.ConnectedAt, ICEState: p.ICEState, Disconnected: p.graceTimer != nil, Talkback: p.talkbackID != ""}
+}
+
+// ChannelInfos returns every channel that has a publisher or is locked, sorted by name
+func (r *Registry) ChannelInfos() []ChannelInfo {
+	r.Lock()
+	defer r.Unlock()
+	names := r.channelNames()
+	for name := range r.locked {
+		if channel, ok := r.channels[name]; !ok || channel.Publisher == nil {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	infos := make([]ChannelInfo, 0, len(names))
+	for _, name := range names {
+		info := ChannelInfo{Name: name, Locked: r.locked[name], Subscribers: make([]SubscriberInfo, 0)}
+		if channel, ok := r.channels[name]; ok && channel.Publisher != nil {
+			info.ChannelMeta = channel.Meta
+			info.Publisher = newPublisherInfo(channel.Publisher)
+			info.Standby = newPublisherInfo(channel.Standby)
+			for _, s := range channel.Subscribers {
+				info.Subscribers = append(info.Subscribers, SubscriberInfo{ID: s.ID, Addr: s.Addr, ConnectedAt: s.ConnectedAt, ICEState: s.ICEState})
+			}
+			sort.Slice(info.Subscribers, func(i, j int) bool {
+				return info.Subscribers[i].ConnectedAt.Before(info.Subscribers[j].ConnectedAt)
+			})
+			al := channel.audioLevel()
+			info.AudioLevel = &al
+			info.Muted = channel.muted()
+		}
+		infos = append(infos, info)
+	}
+	return infos
+}
+
+// KickPublisher disconnects the channel's active or standby publisher with the given ID.
+// As with RemovePublisher, a standby goes on air in place of the active publisher, but
+// the channel isn't held open for the kicked publisher to reconnect
+func (r *Registry) KickPublisher(channelName string, id string) error {
+	r.Lock()
+	defer r.Unlock()
+	channel, ok := r.channels[channelName]
+	if !ok {
+		return fmt.Errorf("channel %q not found", channelName)
+	}
+	var p *Publisher
+	switch {
+	case channel.Standby != nil && channel.Standby.ID == id:
+		p = channel.Standby
+		channel.Standby = nil
+	case channel.Publisher != nil && channel.Publisher.ID == id:
+		p = channel.Publisher
+		if p.graceTimer != nil {
+			p.graceTimer.Stop()
+		}
+		if channel.Standby != nil {
+			moveTalkback(p, channel.Standby)
+			channel.setPublisher(channel.Standby)
+			channel.Standby = nil
+		} else {
+			channel.removePublisher(channelName)
+			r.notifyWatchers()
+		}
+	default:
+		return fmt.Errorf("publisher %q not found on channel %q", id, channelName)
+	}
+	close(p.QuitChan)
+	slog.Info("publisher kicked", "channel", channelName, "publisher", id)
+	return nil
+}
+
+// KickSubscriber disconnects the subscriber with the given ID from the channel
+func (r *Registry) KickSubscriber(channelName string, id string) error {
+	r.Lock()
+	defer r.Unlock()
+	channel, ok := r.channels[channelName]
+	if !ok {
+		return fmt.Errorf("channel %q not found", channelName)
+	}
+	s, ok := channel.Subscribers[id]
+	if !ok {
+		return fmt.Errorf("subscriber %q not found on channel %q", id, channelName)
+	}
+	close(s.QuitChan)
+	delete(channel.Subscribers, id)
+	slog.Info("subscriber kicked", "channel", channelName, "subscriber", id)
+	r.subscribersChanged(channel)
+	return nil
+}
+
+// LockChannel stops new publishers from joining the channel, e.g. so that a kicked
+// publisher can't reconnect. The channel's current publishers and subscribers are unaffected
+func (r *Registry) LockChannel(channelName string) {
+	r.Lock()
+	defer r.Unlock()
+	r.locked[channelName] = true
+	slog.Info("channel locked", "channel", channelName)
+}
+
+func (r *Registry) UnlockChannel(channelName string) {
+	r.Lock()
+	defer r.Unlock()
+	delete(r.locked, channelName)
+	slog.Info("channel unlocked", "channel", channelName)
+}
+
+// MuteChannel stops or restarts forwarding the channel's audio to its subscribers. The channel's
+// audio level is still monitored while it is muted
+func (r *Registry) MuteChannel(channelName string, muted bool) error {
+	r.Lock()
+	defer r.Unlock()
+	channel, ok := r.channels[channelName]
+	if !ok || channel.Publisher == nil {
+		return fmt.Errorf("channel %q not found", channelName)
+	}
+	channel.writer.setMuted(muted)
+	slog.Info("channel muted", "channel", channelName, "muted", muted)
+	return nil
+}
+
+func (channel *Channel) muted() bool {
+	channel.writer.Lock()
+	defer channel.writer.Unlock()
+	return channel.writer.muted
+}
+
+// SetICEState records the ICE connection state of the publisher or subscriber with the given ID
+func (r *Registry) SetICEState(channelName string, id string, state webrtc.ICEConnectionState) {
+	r.Lock()
+	defer r.Unlock()
+	channel, ok := r.channels[channelName]
+	if !ok {
+		return
+	}
+	for _, p := range []*Publisher{channel.Publisher, channel.Standby} {
+		if p != nil && p.ID == id {
+			p.ICEState = state.String()
+		}
+	}
+	if s, ok := channel.Subscribers[id]; ok {
+		s.ICEState = state.String()
+	}
+}
+
+// adminAuth only lets requests with the admin password as a bearer token through
+func adminAuth(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !hmac.Equal([]byte(bearerToken(r)), []byte(adminPassword)) {
+			slog.Warn("admin API unauthorized", "remote_addr", clientAddress(r))
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "incorrect admin password", http.StatusUnauthorized)
+			return
+		}
+		h(w, r)
+	}
+}
+
+func adminChannelsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(reg.ChannelInfos())
+}
+
+func adminKickPublisherHandler(w http.ResponseWriter, r *http.Request) {
+	if err := reg.KickPublisher(r.PathValue("channel"), r.PathValue("id")); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func adminKickSubscriberHandler(w http.ResponseWriter, r *http.Request) {
+	if err := reg.KickSubscriber(r.PathValue("channel"), r.PathValue("id")); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func adminMuteHandler(w http.ResponseWriter, r *http.Request) {
+	if err := reg.MuteChannel(r.PathValue("channel"), r.Method == http.MethodPut); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func adminLockHandler(w http.ResponseWriter, r *http.Request) {
+	channelName := r.PathValue("channel")
+	if err := checkChannelName(channelName); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	reg.LockChannel(channelName)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func adminUnlockHandler(w http.ResponseWriter, r *http.Request) {
+	reg.UnlockChannel(r.PathValue("channel"))
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,181 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+var errListenerAuth = errors.New("incorrect listener password or token")
+
+// ChannelConfig is a channel reserved ahead of time in the channels config file
+type ChannelConfig struct {
+	Name string
+	// PublisherPassword is required to publish to this channel, in place of the global publisher
+	// password. If empty, the global publisher password applies
+	PublisherPassword string
+	// ListenerPassword makes the channel private. Subscribers must supply it, or a token signed with it
+	ListenerPassword string
+	// OpusMaxAverageBitrate and OpusStereo override -opus-max-bitrate and -opus-stereo for the
+	// channel's publishers. If unset, the flags apply
+	OpusMaxAverageBitrate int
+	OpusStereo            *bool
+}
+
+// ChannelConfigs holds reserved channels keyed by name. It is read-only once loaded
+type ChannelConfigs map[string]*ChannelConfig
+
+// LoadChannelConfigs reads reserved channels from a JSON file containing a list of channels e.g.
+//
+//	[{"Name": "Spanish", "PublisherPassword": "secret", "ListenerPassword": "listen"}]
+func LoadChannelConfigs(path string) (ChannelConfigs, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var list []*ChannelConfig
+	if err := json.Unmarshal(raw, &list); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	configs := make(ChannelConfigs)
+	for _, cc := range list {
+		if err := checkChannelName(cc.Name); err != nil {
+			return nil, fmt.Errorf("channel %q: %w", cc.Name, err)
+		}
+		if _, ok := configs[cc.Name]; ok {
+			return nil, fmt.Errorf("channel %q is listed more than once", cc.Name)
+		}
+		if err := checkOpusBitrate(cc.OpusMaxAverageBitrate); err != nil {
+			return nil, fmt.Errorf("channel %q: %w", cc.Name, err)
+		}
+		configs[cc.Name] = cc
+	}
+	return configs, nil
+}
+
+// PublisherPassword returns the password needed to publish to the channel. Reserved
+// channels may have their own password, all others use the global publisher password
+func (cc ChannelConfigs) PublisherPassword(channelName string) string {
+	if c, ok := cc[channelName]; ok && c.PublisherPassword != "" {
+		return c.PublisherPassword
+	}
+	return publisherPassword
+}
+
+// PublisherCodecs returns the codecs the channel's publishers may use, with the channel's own
+// Opus format parameters
+func (cc ChannelConfigs) PublisherCodecs(channelName string) []webrtc.RTPCodecParameters {
+	codecs := slices.Clone(publisherCodecs)
+	for i := range codecs {
+		if strings.EqualFold(codecs[i].MimeType, webrtc.MimeTypeOpus) {
+			codecs[i].SDPFmtpLine = cc.OpusFmtpLine(channelName)
+		}
+	}
+	return codecs
+}
+
+// OpusFmtpLine returns the Opus format parameters sent to the channel's publishers. Reserved
+// channels may override the global bitrate and stereo settings
+func (cc ChannelConfigs) OpusFmtpLine(channelName string) string {
+	mc := mediaConfig
+	if c, ok := cc[channelName]; ok {
+		if c.OpusMaxAverageBitrate != 0 {
+			mc.OpusMaxAverageBitrate = c.OpusMaxAverageBitrate
+		}
+		if c.OpusStereo != nil {
+			mc.OpusStereo = *c.OpusStereo
+		}
+	}
+	return mc.opusFmtpLine()
+}
+
+// PublisherPasswordRequired reports whether publishers may be asked for a password
+func (cc ChannelConfigs) PublisherPasswordRequired() bool {
+	if publisherPassword != "" {
+		return true
+	}
+	for _, c := range cc {
+		if c.PublisherPassword != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// ListenerAuthRequired reports whether subscribers need a password or token for the channel
+func (cc ChannelConfigs) ListenerAuthRequired(channelName string) bool {
+	c, ok := cc[channelName]
+	return ok && c.ListenerPassword != ""
+}
+
+// CheckListener returns nil if the subscriber may listen to the channel, given either the
+// channel's listener password or a valid listener token
+func (cc ChannelConfigs) CheckListener(channelName string, password string, token string) error {
+	if !cc.ListenerAuthRequired(channelName) {
+		return nil
+	}
+	c := cc[channelName]
+	if password != "" && hmac.Equal([]byte(password), []byte(c.ListenerPassword)) {
+		return nil
+	}
+	if token != "" && checkListenerToken(c, token) {
+		return nil
+	}
+	return errListenerAuth
+}
+
+// NewListenerToken returns a token that lets a subscriber listen to the channel until it expires.
+// Tokens are signed with the channel's listener password, changing the password revokes them
+func (cc ChannelConfigs) NewListenerToken(channelName string, ttl time.Duration) (string, error) {
+	if !cc.ListenerAuthRequired(channelName) {
+		return "", fmt.Errorf("channel %q has no listener password", channelName)
+	}
+	expiry := strconv.FormatInt(time.Now().Add(ttl).Unix(), 10)
+	return expiry + "." + listenerTokenSignature(cc[channelName], expiry), nil
+}
+
+// tokens have the form <expiry unix time>.<signature>
+func checkListenerToken(c *ChannelConfig, token string) bool {
+	expiry, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return false
+	}
+	if !hmac.Equal([]byte(sig), []byte(listenerTokenSignature(c, expiry))) {
+		return false
+	}
+	expiryUnix, err := strconv.ParseInt(expiry, 10, 64)
+	if err != nil {
+		return false
+	}
+	return time.Now().Unix() < expiryUnix
+}
+
+func listenerTokenSignature(c *ChannelConfig, expiry string) string {
+	mac := hmac.New(sha256.New, []byte(c.ListenerPassword))
+	mac.Write([]byte(c.Name + "\n" + expiry))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,128 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPublisherPassword(t *testing.T) {
+	defer func(p string) { publisherPassword = p }(publisherPassword)
+	publisherPassword = "global"
+
+	cc := ChannelConfigs{
+		"Spanish": {Name: "Spanish", PublisherPassword: "spanish"},
+		// listener-only entries must not open the channel to any publisher
+		"Board": {Name: "Board", ListenerPassword: "x"},
+	}
+	tests := []struct {
+		channel string
+		want    string
+	}{
+		{"Spanish", "spanish"},
+		{"Board", "global"},
+		{"Other", "global"},
+	}
+	for _, tt := range tests {
+		if got := cc.PublisherPassword(tt.channel); got != tt.want {
+			t.Errorf("PublisherPassword(%q) = %q, want %q", tt.channel, got, tt.want)
+		}
+	}
+
+	defer func(c ChannelConfigs) { channelConfigs = c }(channelConfigs)
+	channelConfigs = cc
+	if err := checkPublisher(CmdConnect{Channel: "Board"}); err != errIncorrectPassword {
+		t.Errorf("publishing to a listener-only channel without a password: got %v, want %v", err, errIncorrectPassword)
+	}
+	if err := checkPublisher(CmdConnect{Channel: "Board", Password: "global"}); err != nil {
+		t.Errorf("publishing to a listener-only channel with the global password: %v", err)
+	}
+}
+
+func TestOpusFmtpLine(t *testing.T) {
+	defer func(mc MediaConfig) { mediaConfig = mc }(mediaConfig)
+	mediaConfig = MediaConfig{OpusInbandFEC: true, OpusMaxAverageBitrate: 24000}
+
+	mono := false
+	stereo := true
+	cc := ChannelConfigs{
+		"Music":  {Name: "Music", OpusMaxAverageBitrate: 128000, OpusStereo: &stereo},
+		"Speech": {Name: "Speech", OpusStereo: &mono},
+	}
+	tests := []struct {
+		channel string
+		want    string
+	}{
+		{"Music", "minptime=10;useinbandfec=1;stereo=1;sprop-stereo=1;maxaveragebitrate=128000"},
+		{"Speech", "minptime=10;useinbandfec=1;maxaveragebitrate=24000"},
+		{"Other", "minptime=10;useinbandfec=1;maxaveragebitrate=24000"},
+	}
+	for _, tt := range tests {
+		if got := cc.OpusFmtpLine(tt.channel); got != tt.want {
+			t.Errorf("OpusFmtpLine(%q) = %q, want %q", tt.channel, got, tt.want)
+		}
+	}
+}
+
+func TestListenerToken(t *testing.T) {
+	cc := ChannelConfigs{
+		"Board":  {Name: "Board", ListenerPassword: "board"},
+		"Budget": {Name: "Budget", ListenerPassword: "board"},
+		"Public": {Name: "Public"},
+	}
+	valid, err := cc.NewListenerToken("Board", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, err := cc.NewListenerToken("Board", -time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expiry, sig, _ := strings.Cut(valid, ".")
+	// the last character only carries some of the signature's bits, so change the first
+	tampered := expiry + "." + string(sig[0]^1) + sig[1:]
+	later := strconv.FormatInt(time.Now().Add(24*time.Hour).Unix(), 10)
+
+	tests := []struct {
+		name    string
+		channel string
+		token   string
+		want    bool
+	}{
+		{"valid", "Board", valid, true},
+		{"expired", "Board", expired, false},
+		{"tampered signature", "Board", tampered, false},
+		{"extended expiry", "Board", later + "." + sig, false},
+		{"other channel with the same password", "Budget", valid, false},
+		{"no signature", "Board", expiry, false},
+		{"empty", "Board", "", false},
+	}
+	for _, tt := range tests {
+		if got := checkListenerToken(cc[tt.channel], tt.token); got != tt.want {
+			t.Errorf("%s: checkListenerToken = %v, want %v", tt.name, got, tt.want)
+		}
+		err := cc.CheckListener(tt.channel, "", tt.token)
+		if (err == nil) != tt.want {
+			t.Errorf("%s: CheckListener error %v, want valid %v", tt.name, err, tt.want)
+		}
+	}
+
+	if _, err := cc.NewListenerToken("Public", time.Hour); err == nil {
+		t.Error("expected an error making a token for a channel without a listener password")
+	}
+}
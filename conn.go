@@ -21,15 +21,24 @@ import (
 	"io"
 	"log/slog"
 	"regexp"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/pion/rtp"
 	"github.com/pion/webrtc/v4"
 )
 
 // channel name should NOT match the negation of valid characters
 var channelRegexp = regexp.MustCompile("[^a-zA-Z0-9 ]+")
 
+var errIncorrectPassword = errors.New("incorrect password")
+
+// how long an active publisher's ICE can stay disconnected before their standby takes over.
+// Brief disconnects often recover by themselves
+const handOverDelay = 3 * time.Second
+
 type Conn struct {
 	sync.Mutex
 	peer        *WebRTCPeer
@@ -39,24 +48,69 @@ type Conn struct {
 	quitchan    chan struct{}
 	logger      *slog.Logger
 	hasClosed   bool
+	quitOnce    sync.Once
 
 	clientID    string
 	isPublisher bool
+	publisher   *Publisher
+	// resumeToken is issued to a WHIP publisher before it is added, see AddPublisher
+	resumeToken string
+	// addr is the client's address for display, including port and any X-Forwarded-For
+	addr string
+
+	// channelsChan receives channel list updates, once the client has asked to watch them
+	channelsChan chan []ChannelListing
+	watchID      string
+	// countChan receives the channel's subscriber count, once the client has joined a channel
+	countChan chan int
+	// relay is the channel a publisher is listening to, if any
+	relay *relay
+	// talkback is set for an operator talking to a channel's publisher, and writes their
+	// audio to the publisher
+	talkback *talkbackWriter
+	// talkbackTrack is an operator's audio, once received from their track handler
+	talkbackTrack *webrtc.TrackLocalStaticRTP
+	// talkbackSender sends a publisher the operator talking to them, if any
+	talkbackSender *webrtc.RTPSender
 }
 
 func NewConn(ws *websocket.Conn) *Conn {
+	c := newConn(ws.RemoteAddr().String())
+	c.wsConn = ws
+
+	return c
+}
+
+// newConn returns a Conn without a websocket attached. It is used directly by
+// the HTTP (WHIP) signaling handlers.
+func newConn(remoteAddr string) *Conn {
 	c := &Conn{}
 	c.infoChan = make(chan string)
 	c.quitchan = make(chan struct{})
-	c.logger = slog.With("remote_addr", ws.RemoteAddr())
-	c.wsConn = ws
+	c.addr = remoteAddr
+	c.logger = slog.With("remote_addr", remoteAddr)
 
 	return c
 }
 
+// quit signals the connection's handler loop to exit. It is safe to call more than once.
+func (c *Conn) quit() {
+	c.quitOnce.Do(func() {
+		close(c.quitchan)
+	})
+}
+
+// sendInfo passes an info message to the connection's handler loop, unless it has already quit
+func (c *Conn) sendInfo(info string) {
+	select {
+	case c.infoChan <- info:
+	case <-c.quitchan:
+	}
+}
+
 func (c *Conn) setupSessionPublisher(offer webrtc.SessionDescription) error {
 
-	answer, err := c.peer.SetupPublisher(offer, c.rtcStateChangeHandler, c.rtcTrackHandlerPublisher, c.onIceCandidate)
+	answer, err := c.peer.SetupPublisher(offer, publisherCodecs, c.rtcStateChangeHandler, c.rtcTrackHandlerPublisher, c.onIceCandidate)
 	if err != nil {
 		return err
 	}
@@ -97,35 +151,175 @@ func (c *Conn) setupSessionSubscriber() error {
 	return nil
 }
 
-func (c *Conn) connectPublisher(cmd CmdConnect) error {
+// switchChannel moves a subscriber to another channel on the same connection, by replacing
+// the track they are sent. No renegotiation is needed
+func (c *Conn) switchChannel(cmd CmdConnect) error {
+	sender := c.peer.subscriberSender
+	if sender == nil || c.clientID == "" {
+		return fmt.Errorf("not subscribed to a channel")
+	}
+	if cmd.Channel == c.channelName {
+		return nil
+	}
+	channel := reg.GetChannel(cmd.Channel)
+	if channel == nil {
+		return fmt.Errorf("channel %q not found", cmd.Channel)
+	}
+	if err := checkOfferCodecs(c.peer.pc.RemoteDescription(), []webrtc.RTPCodecParameters{{RTPCodecCapability: channel.Codec}}); err != nil {
+		return fmt.Errorf("channel uses codec %s, which this client doesn't support", channel.Codec.MimeType)
+	}
 
-	if c.peer.pc == nil {
-		return fmt.Errorf("webrtc session not established")
+	old := sender.Track()
+	if err := sender.ReplaceTrack(channel.LocalTrack); err != nil {
+		return err
 	}
+	// hold the lock so that the channel name always matches the channel the subscriber is in
+	c.Lock()
+	defer c.Unlock()
+	if err := reg.MoveSubscriber(c.channelName, cmd.Channel, c.clientID); err != nil {
+		if old != nil {
+			sender.ReplaceTrack(old)
+		}
+		return err
+	}
+	c.logger.Info("subscriber switched channel", "from", c.channelName, "to", cmd.Channel)
+	c.channelName = cmd.Channel
+	return nil
+}
 
-	if cmd.Channel == "" {
+// currentChannel returns the client's channel name. Subscribers can switch channel, so
+// anything running outside the websocket read loop must read it this way
+func (c *Conn) currentChannel() string {
+	c.Lock()
+	defer c.Unlock()
+	return c.channelName
+}
+
+func checkChannelName(channelName string) error {
+	if channelName == "" {
 		return fmt.Errorf("channel cannot be empty")
 	}
 
-	if channelRegexp.MatchString(cmd.Channel) {
+	if channelRegexp.MatchString(channelName) {
 		return fmt.Errorf("channel name must contain only alphanumeric characters")
 	}
 
-	if publisherPassword != "" && cmd.Password != publisherPassword {
-		return fmt.Errorf("incorrect password")
+	return nil
+}
+
+// activeChan returns the channel on which publisher state changes are received, or nil if
+// the connection is not (yet) a publisher
+func (c *Conn) activeChan() chan bool {
+	if c.publisher == nil {
+		return nil
+	}
+	return c.publisher.ActiveChan
+}
+
+// checkPublisher validates the channel name and password supplied by a publisher
+func checkPublisher(cmd CmdConnect) error {
+	if err := checkChannelName(cmd.Channel); err != nil {
+		return err
 	}
 
+	if err := checkNotMix(cmd.Channel); err != nil {
+		return err
+	}
+
+	if password := channelConfigs.PublisherPassword(cmd.Channel); password != "" && cmd.Password != password {
+		return errIncorrectPassword
+	}
+
+	return checkChannelMeta(cmd.ChannelMeta)
+}
+
+func (c *Conn) connectPublisher(cmd CmdConnect) (*Publisher, error) {
+
+	if c.peer.pc == nil {
+		return nil, fmt.Errorf("webrtc session not established")
+	}
+
+	if err := checkPublisher(cmd); err != nil {
+		return nil, err
+	}
+
+	c.Lock()
 	c.channelName = cmd.Channel
+	c.Unlock()
 	c.logger.Info("setting up publisher for channel", "channel", c.channelName)
+	// the session was answered before the channel was known, so send the channel's own
+	// Opus parameters if it has them. WHIP publishers were answered with them
+	if c.wsConn != nil && channelConfigs.OpusFmtpLine(cmd.Channel) != mediaConfig.opusFmtpLine() {
+		if err := c.peer.SetPublisherCodecs(channelConfigs.PublisherCodecs(cmd.Channel)); err != nil {
+			return nil, err
+		}
+		if err := c.renegotiate(); err != nil {
+			return nil, err
+		}
+	}
 
-	localTrack := <-c.peer.localTrackChan
+	var localTrack *webrtc.TrackLocalStaticRTP
+	select {
+	case localTrack = <-c.peer.localTrackChan:
+	case <-c.quitchan:
+		return nil, fmt.Errorf("connection closed before publisher track was received")
+	}
 	c.logger.Info("publisher has localTrack")
 
-	if err := reg.AddPublisher(c.channelName, localTrack); err != nil {
+	p, err := reg.AddPublisher(c.channelName, localTrack, c.addr, cmd.ResumeToken, c.resumeToken, cmd.Standby, cmd.ChannelMeta)
+	if err != nil {
+		return nil, err
+	}
+	c.Lock()
+	c.clientID = p.ID
+	c.publisher = p
+	c.Unlock()
+	if c.wsConn != nil {
+		reg.AcceptTalkback(c.channelName, p.ID)
+	}
+	// state changes from now on are recorded by rtcStateChangeHandler
+	reg.SetICEState(c.channelName, p.ID, c.peer.pc.ICEConnectionState())
+	metricPublisherSessionsStarted.Inc()
+
+	go func() {
+		select {
+		case <-p.QuitChan:
+			c.logger.Info("publisher disconnected by admin or resumed elsewhere", "channel", c.channelName)
+			c.quit()
+		case <-c.quitchan:
+		}
+	}()
+
+	// hand the publisher to the track handler so it can start forwarding
+	select {
+	case c.peer.publisherChan <- p:
+	case <-c.quitchan:
+		return nil, fmt.Errorf("connection closed before publisher track was forwarded")
+	}
+
+	return p, nil
+}
+
+// renegotiate sends the client a new offer after the server has changed the session. If an
+// offer is already awaiting an answer, another is sent once it arrives
+func (c *Conn) renegotiate() error {
+	offer, err := c.peer.Renegotiate()
+	if err != nil {
 		return err
 	}
+	return c.sendOffer(offer)
+}
 
-	return nil
+// sendOffer sends the client an offer to renegotiate, if there is one
+func (c *Conn) sendOffer(offer *webrtc.SessionDescription) error {
+	if offer == nil {
+		return nil
+	}
+	j, err := json.Marshal(offer.SDP)
+	if err != nil {
+		return err
+	}
+	return c.writeMsg(wsMsg{Key: "renegotiate_offer", Value: j})
 }
 
 func (c *Conn) Close() {
@@ -135,12 +329,24 @@ func (c *Conn) Close() {
 	if c.hasClosed {
 		return
 	}
-	if c.isPublisher {
-		reg.RemovePublisher(c.channelName)
+	c.quit()
+	if c.watchID != "" {
+		reg.UnwatchChannels(c.watchID)
+	}
+	if c.talkback != nil {
+		reg.EndTalkback(c.channelName, c.clientID)
+	} else if c.isPublisher {
+		if c.publisher != nil {
+			metricPublisherSessionsEnded.Inc()
+		}
+		reg.RemovePublisher(c.channelName, c.clientID)
+		if c.relay != nil {
+			reg.RemoveSubscriber(c.relay.channelName, c.relay.subscriber.ID)
+		}
 	} else {
 		reg.RemoveSubscriber(c.channelName, c.clientID)
 	}
-	if c.peer.pc != nil {
+	if c.peer != nil && c.peer.pc != nil {
 		c.peer.pc.Close()
 	}
 	if c.wsConn != nil {
@@ -174,10 +380,36 @@ func (c *Conn) rtcTrackHandlerPublisher(remoteTrack *webrtc.TrackRemote, receive
 	}
 
 	c.logger.Debug("trackhandler sending localtrack")
-	c.peer.localTrackChan <- localTrack
+	select {
+	case c.peer.localTrackChan <- localTrack:
+	case <-c.quitchan:
+		return
+	}
 	c.logger.Debug("trackhandler sent localtrack")
 
+	// wait for the publisher to be registered. If the publisher is resuming a channel,
+	// its packets are written to the channel's existing local track rather than ours
+	var p *Publisher
+	select {
+	case p = <-c.peer.publisherChan:
+	case <-c.quitchan:
+		return
+	}
+	p.AudioLevelExtID = audioLevelExtensionID(receiver)
+
+	var rec *Recorder
+	if recordDir != "" {
+		if strings.EqualFold(remoteTrack.Codec().MimeType, webrtc.MimeTypeOpus) {
+			rec = NewRecorder(recordDir, recordRotate, c.channelName, p.ID[:8], c.logger)
+			reg.AddRecorder(rec)
+			defer rec.Close()
+		} else {
+			c.logger.Warn("only Opus can be recorded, not recording", "codec", remoteTrack.Codec().MimeType)
+		}
+	}
+
 	rtpBuf := make([]byte, 1400)
+	pkt := &rtp.Packet{}
 	for {
 		i, _, readErr := remoteTrack.Read(rtpBuf)
 		if readErr != nil {
@@ -187,10 +419,21 @@ func (c *Conn) rtcTrackHandlerPublisher(remoteTrack *webrtc.TrackRemote, receive
 			return
 		}
 
+		if err := pkt.Unmarshal(rtpBuf[:i]); err != nil {
+			c.logger.Error("rtp unmarshal error", "err", err)
+			continue
+		}
+
+		// record before forwarding, as forwarding rewrites the packet's header
+		if rec != nil {
+			rec.WriteRTP(pkt)
+		}
+
 		// ErrClosedPipe means we don't have any subscribers, this is ok if no peers have connected yet
-		_, err := localTrack.Write(rtpBuf[:i])
+		err := p.WriteRTP(pkt)
 		if err != nil {
 			c.logger.Error("localTrack.write error", "err", err)
+			metricTrackWriteErrors.WithLabelValues(c.channelName).Inc()
 			if !errors.Is(err, io.ErrClosedPipe) {
 				return
 			}
@@ -200,16 +443,54 @@ func (c *Conn) rtcTrackHandlerPublisher(remoteTrack *webrtc.TrackRemote, receive
 
 // WebRTC callback function
 func (c *Conn) rtcStateChangeHandler(connectionState webrtc.ICEConnectionState) {
+	metricICEStates.WithLabelValues(connectionState.String()).Inc()
+	c.Lock()
+	name, id := c.channelName, c.clientID
+	rl := c.relay
+	c.Unlock()
+	if id != "" {
+		reg.SetICEState(name, id, connectionState)
+	}
+	if rl != nil {
+		reg.SetICEState(rl.channelName, rl.subscriber.ID, connectionState)
+	}
 	switch connectionState {
 	case webrtc.ICEConnectionStateConnected:
 		c.logger.Info("ice connected")
 		c.logger.Debug("remote SDP", "sdp", c.peer.pc.RemoteDescription().SDP)
 		c.logger.Debug("local SDP", "sdp", c.peer.pc.LocalDescription().SDP)
-		c.infoChan <- "ice connected"
+		c.sendInfo("ice connected")
 
 	case webrtc.ICEConnectionStateDisconnected:
 		c.logger.Info("ice disconnected")
-		c.infoChan <- "ice disconnected"
+		c.sendInfo("ice disconnected")
+
+		// an active publisher that stays disconnected hands over to the channel's standby
+		time.AfterFunc(handOverDelay, func() {
+			if c.peer.pc.ICEConnectionState() == webrtc.ICEConnectionStateDisconnected {
+				c.handOverToStandby("ice disconnected")
+			}
+		})
+
+	case webrtc.ICEConnectionStateFailed:
+		c.logger.Info("ice failed")
+		c.sendInfo("ice failed")
+		c.handOverToStandby("ice failed")
+		c.quit()
+	}
+}
+
+// handOverToStandby hands a publisher's channel over to its standby, if they are the
+// active publisher and the channel has a connected standby
+func (c *Conn) handOverToStandby(reason string) {
+	c.Lock()
+	name, p := c.channelName, c.publisher
+	c.Unlock()
+	if p == nil {
+		return
+	}
+	if err := reg.HandOver(name, p.ID); err == nil {
+		c.logger.Info("publisher handed over to standby", "reason", reason, "channel", name)
 	}
 }
 
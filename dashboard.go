@@ -0,0 +1,168 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/hmac"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// how often the admin dashboard is sent the state of every channel
+	dashboardInterval = 500 * time.Millisecond
+	// how long the admin dashboard has to send the password once connected
+	dashboardAuthTimeout = 10 * time.Second
+)
+
+// CmdAdmin is a command from the admin dashboard
+type CmdAdmin struct {
+	Channel string
+	// ID is the publisher or subscriber to kick
+	ID string
+	// Locked and Muted are the new state for the lock and mute commands
+	Locked bool
+	Muted  bool
+}
+
+// adminWSHandler serves the admin dashboard's websocket. The dashboard must send the admin
+// password first. It is then sent the state of every channel every dashboardInterval, and
+// may send commands to kick publishers and subscribers, and lock and mute channels
+func adminWSHandler(w http.ResponseWriter, r *http.Request) {
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		slog.Error("admin websocket upgrade error", "err", err)
+		return
+	}
+	defer ws.Close()
+	logger := slog.With("remote_addr", clientAddress(r))
+
+	write := func(m wsMsg) error {
+		ws.SetWriteDeadline(time.Now().Add(WriteWait))
+		return ws.WriteJSON(m)
+	}
+	writeError := func(err error) error {
+		j, _ := json.Marshal(err.Error())
+		return write(wsMsg{Key: "error", Value: j})
+	}
+
+	ws.SetReadDeadline(time.Now().Add(dashboardAuthTimeout))
+	var auth wsMsg
+	if err := ws.ReadJSON(&auth); err != nil {
+		logger.Error("admin websocket read error", "err", err)
+		return
+	}
+	var password string
+	json.Unmarshal(auth.Value, &password)
+	if auth.Key != "auth" || !hmac.Equal([]byte(password), []byte(adminPassword)) {
+		logger.Warn("admin dashboard unauthorized")
+		writeError(fmt.Errorf("incorrect admin password"))
+		return
+	}
+	ws.SetReadDeadline(time.Time{})
+	logger.Info("admin dashboard connected")
+	if err := write(wsMsg{Key: "auth_ok"}); err != nil {
+		return
+	}
+
+	// websocket connections support one concurrent reader and one concurrent writer.
+	// we put reads in a new goroutine below and leave writes in this one
+	cmds := make(chan wsMsg)
+	done := make(chan struct{})
+	defer close(done)
+	readQuit := make(chan struct{})
+	go func() {
+		defer close(readQuit)
+		for {
+			var m wsMsg
+			if err := ws.ReadJSON(&m); err != nil {
+				if !websocket.IsCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+					logger.Error("admin websocket read error", "err", err)
+				}
+				return
+			}
+			select {
+			case cmds <- m:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	sendChannels := func() error {
+		j, err := json.Marshal(reg.ChannelInfos())
+		if err != nil {
+			return err
+		}
+		return write(wsMsg{Key: "channels", Value: j})
+	}
+
+	ticker := time.NewTicker(dashboardInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case m := <-cmds:
+			if err := handleAdminCmd(m); err != nil {
+				logger.Warn("admin command error", "key", m.Key, "err", err)
+				if err := writeError(err); err != nil {
+					return
+				}
+			}
+			// show the result straight away
+			if err := sendChannels(); err != nil {
+				return
+			}
+		case <-ticker.C:
+			if err := sendChannels(); err != nil {
+				logger.Error("admin websocket write error", "err", err)
+				return
+			}
+		case <-readQuit:
+			logger.Info("admin dashboard disconnected")
+			return
+		}
+	}
+}
+
+func handleAdminCmd(msg wsMsg) error {
+	var cmd CmdAdmin
+	if err := json.Unmarshal(msg.Value, &cmd); err != nil {
+		return err
+	}
+	switch msg.Key {
+	case "kick_publisher":
+		return reg.KickPublisher(cmd.Channel, cmd.ID)
+	case "kick_subscriber":
+		return reg.KickSubscriber(cmd.Channel, cmd.ID)
+	case "lock":
+		if !cmd.Locked {
+			reg.UnlockChannel(cmd.Channel)
+			return nil
+		}
+		if err := checkChannelName(cmd.Channel); err != nil {
+			return err
+		}
+		reg.LockChannel(cmd.Channel)
+		return nil
+	case "mute":
+		return reg.MuteChannel(cmd.Channel, cmd.Muted)
+	}
+	return fmt.Errorf("unknown command %q", msg.Key)
+}
@@ -0,0 +1,177 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// the smallest timestamp gap we leave when switching source, one typical Opus frame
+const minSourceGap = 20 * time.Millisecond
+
+// how many packets a tap can fall behind before its packets are dropped
+const tapBufferSize = 50
+
+// packetTaps passes copies of a channel's forwarded packets to consumers within the server,
+// such as mixers. Taps are kept by channel name, so they carry on across publishers
+type packetTaps struct {
+	sync.Mutex
+	taps map[string]chan *rtp.Packet
+}
+
+func newPacketTaps() *packetTaps {
+	return &packetTaps{taps: make(map[string]chan *rtp.Packet)}
+}
+
+func (t *packetTaps) add(id string) chan *rtp.Packet {
+	t.Lock()
+	defer t.Unlock()
+	ch := make(chan *rtp.Packet, tapBufferSize)
+	t.taps[id] = ch
+	return ch
+}
+
+func (t *packetTaps) remove(id string) {
+	t.Lock()
+	defer t.Unlock()
+	if ch, ok := t.taps[id]; ok {
+		close(ch)
+		delete(t.taps, id)
+	}
+}
+
+// send passes a copy of the packet to every tap, dropping it for taps that are full
+func (t *packetTaps) send(pkt *rtp.Packet) {
+	t.Lock()
+	defer t.Unlock()
+	for _, ch := range t.taps {
+		select {
+		case ch <- pkt.Clone():
+		default:
+		}
+	}
+}
+
+// trackWriter writes publisher RTP packets to a channel's local track. Sequence numbers
+// and timestamps are rewritten so that subscribers see one continuous stream, even when
+// the publisher feeding the channel changes
+type trackWriter struct {
+	sync.Mutex
+	track *webrtc.TrackLocalStaticRTP
+
+	packets prometheus.Counter
+	bytes   prometheus.Counter
+
+	// meter keeps the active source's audio level. Packets quieter than silenceLevel
+	// (in dBov) count as silence
+	meter        levelMeter
+	silenceLevel float64
+	// muted drops all packets, without leaving a gap in sequence numbers
+	muted bool
+	// taps receive a copy of each packet written to the track
+	taps *packetTaps
+
+	// active is the only source whose packets are forwarded
+	active string
+	sourceJoiner
+}
+
+// sourceJoiner rewrites sequence numbers and timestamps so that packets from a series of
+// sources, each with their own numbering, form one continuous stream
+type sourceJoiner struct {
+	source    string
+	seqOffset uint16
+	tsOffset  uint32
+	lastSeq   uint16
+	lastTS    uint32
+	lastWrite time.Time
+}
+
+// join rewrites a packet from the given source to follow on from the last packet joined
+func (j *sourceJoiner) join(source string, pkt *rtp.Packet, clockRate uint32) {
+	if source != j.source {
+		if j.source != "" {
+			// continue on from the previous source's last packet, leaving a timestamp
+			// gap equal to the time that has passed
+			gap := max(time.Since(j.lastWrite), minSourceGap)
+			ticks := uint32(gap.Seconds() * float64(clockRate))
+			j.seqOffset = j.lastSeq + 1 - pkt.SequenceNumber
+			j.tsOffset = j.lastTS + ticks - pkt.Timestamp
+		}
+		j.source = source
+	}
+	pkt.SequenceNumber += j.seqOffset
+	pkt.Timestamp += j.tsOffset
+	j.lastSeq = pkt.SequenceNumber
+	j.lastTS = pkt.Timestamp
+	j.lastWrite = time.Now()
+}
+
+func newTrackWriter(track *webrtc.TrackLocalStaticRTP, channelName string, silenceLevel float64, taps *packetTaps) *trackWriter {
+	return &trackWriter{
+		track:        track,
+		packets:      metricRTPPackets.WithLabelValues(channelName),
+		bytes:        metricRTPBytes.WithLabelValues(channelName),
+		meter:        newLevelMeter(),
+		silenceLevel: silenceLevel,
+		taps:         taps,
+	}
+}
+
+// setSource sets the source (publisher ID) whose packets are forwarded
+func (tw *trackWriter) setSource(source string) {
+	tw.Lock()
+	defer tw.Unlock()
+	tw.active = source
+}
+
+// setMuted sets whether the track is muted
+func (tw *trackWriter) setMuted(muted bool) {
+	tw.Lock()
+	defer tw.Unlock()
+	tw.muted = muted
+}
+
+// writeRTP writes a packet from the given source (publisher ID) to the track. Packets
+// from any source other than the active one are dropped. levelExtID is the ID of the
+// source's audio level header extension, or 0 if it has none
+func (tw *trackWriter) writeRTP(source string, pkt *rtp.Packet, levelExtID uint8) error {
+	tw.Lock()
+	if source != tw.active {
+		tw.Unlock()
+		return nil
+	}
+	tw.meter.update(pkt, levelExtID, tw.silenceLevel)
+	if tw.muted {
+		tw.seqOffset--
+		tw.Unlock()
+		return nil
+	}
+	tw.join(source, pkt, tw.track.Codec().ClockRate)
+	tw.Unlock()
+
+	tw.taps.send(pkt)
+	if err := tw.track.WriteRTP(pkt); err != nil {
+		return err
+	}
+	tw.packets.Inc()
+	tw.bytes.Add(float64(len(pkt.Payload)))
+	return nil
+}
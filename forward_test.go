@@ -0,0 +1,151 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"math"
+	"testing"
+
+	"github.com/pion/rtp"
+)
+
+// testPacket is a packet from a source, or with op set, a change to the track writer
+type testPacket struct {
+	op     string
+	source string
+	seq    uint16
+	ts     uint32
+}
+
+// checkContinuous checks that sequence numbers follow on without gaps and that timestamps
+// only increase, both allowing for wraparound
+func checkContinuous(t *testing.T, name string, pkts []rtp.Header) {
+	t.Helper()
+	for i := 1; i < len(pkts); i++ {
+		prev, cur := pkts[i-1], pkts[i]
+		if cur.SequenceNumber != prev.SequenceNumber+1 {
+			t.Errorf("%s: packet %d sequence number %d follows %d", name, i, cur.SequenceNumber, prev.SequenceNumber)
+		}
+		if int32(cur.Timestamp-prev.Timestamp) <= 0 {
+			t.Errorf("%s: packet %d timestamp %d follows %d", name, i, cur.Timestamp, prev.Timestamp)
+		}
+	}
+}
+
+func TestSourceJoinerJoin(t *testing.T) {
+	tests := []struct {
+		name string
+		pkts []testPacket
+	}{
+		{"one source", []testPacket{
+			{source: "a", seq: 100, ts: 1000}, {source: "a", seq: 101, ts: 1960}, {source: "a", seq: 102, ts: 2920},
+		}},
+		{"switch to lower numbering", []testPacket{
+			{source: "a", seq: 5000, ts: 900000}, {source: "a", seq: 5001, ts: 900960},
+			{source: "b", seq: 10, ts: 500}, {source: "b", seq: 11, ts: 1460},
+		}},
+		{"switch to higher numbering", []testPacket{
+			{source: "a", seq: 10, ts: 500}, {source: "a", seq: 11, ts: 1460},
+			{source: "b", seq: 40000, ts: 3000000000}, {source: "b", seq: 40001, ts: 3000000960},
+		}},
+		{"switch back", []testPacket{
+			{source: "a", seq: 10, ts: 500}, {source: "b", seq: 300, ts: 70000},
+			{source: "a", seq: 11, ts: 1460}, {source: "a", seq: 12, ts: 2420},
+		}},
+		{"sequence wraparound", []testPacket{
+			{source: "a", seq: math.MaxUint16 - 1, ts: 1000}, {source: "a", seq: math.MaxUint16, ts: 1960},
+			{source: "a", seq: 0, ts: 2920}, {source: "a", seq: 1, ts: 3880},
+		}},
+		{"timestamp wraparound", []testPacket{
+			{source: "a", seq: 1, ts: math.MaxUint32 - 959}, {source: "a", seq: 2, ts: 0}, {source: "a", seq: 3, ts: 960},
+		}},
+		{"switch across wraparound", []testPacket{
+			{source: "a", seq: math.MaxUint16, ts: math.MaxUint32 - 100}, {source: "b", seq: 20000, ts: 20000},
+			{source: "b", seq: 20001, ts: 20960},
+		}},
+	}
+	for _, tt := range tests {
+		var j sourceJoiner
+		var out []rtp.Header
+		for _, p := range tt.pkts {
+			pkt := &rtp.Packet{Header: rtp.Header{SequenceNumber: p.seq, Timestamp: p.ts}}
+			j.join(p.source, pkt, 48000)
+			out = append(out, pkt.Header)
+		}
+		checkContinuous(t, tt.name, out)
+	}
+}
+
+func TestTrackWriterWriteRTP(t *testing.T) {
+	tests := []struct {
+		name string
+		pkts []testPacket
+		// want is the number of packets written
+		want int
+	}{
+		{"mute and unmute", []testPacket{
+			{source: "a", seq: 1, ts: 0}, {source: "a", seq: 2, ts: 960},
+			{op: "mute"}, {source: "a", seq: 3, ts: 1920}, {source: "a", seq: 4, ts: 2880},
+			{op: "unmute"}, {source: "a", seq: 5, ts: 3840}, {source: "a", seq: 6, ts: 4800},
+		}, 4},
+		{"muted across wraparound", []testPacket{
+			{source: "a", seq: math.MaxUint16 - 1, ts: math.MaxUint32 - 1919},
+			{op: "mute"}, {source: "a", seq: math.MaxUint16, ts: math.MaxUint32 - 959}, {source: "a", seq: 0, ts: 0},
+			{op: "unmute"}, {source: "a", seq: 1, ts: 960}, {source: "a", seq: 2, ts: 1920},
+		}, 3},
+		{"inactive source dropped", []testPacket{
+			{source: "a", seq: 1, ts: 0}, {source: "b", seq: 900, ts: 90000}, {source: "a", seq: 2, ts: 960},
+		}, 2},
+		{"switch source", []testPacket{
+			{source: "a", seq: 1, ts: 0}, {op: "source", source: "b"},
+			{source: "a", seq: 2, ts: 960}, {source: "b", seq: 30000, ts: 7}, {source: "b", seq: 30001, ts: 967},
+		}, 3},
+		{"switch source while muted", []testPacket{
+			{source: "a", seq: 1, ts: 0}, {op: "mute"}, {source: "a", seq: 2, ts: 960},
+			{op: "source", source: "b"}, {source: "b", seq: 500, ts: 5000},
+			{op: "unmute"}, {source: "b", seq: 501, ts: 5960}, {source: "b", seq: 502, ts: 6920},
+		}, 3},
+	}
+	for _, tt := range tests {
+		taps := newPacketTaps()
+		tap := taps.add("test")
+		tw := newTrackWriter(newTrack(t), "test", -127, taps)
+		tw.setSource("a")
+		for _, p := range tt.pkts {
+			switch p.op {
+			case "mute":
+				tw.setMuted(true)
+			case "unmute":
+				tw.setMuted(false)
+			case "source":
+				tw.setSource(p.source)
+			default:
+				pkt := &rtp.Packet{Header: rtp.Header{SequenceNumber: p.seq, Timestamp: p.ts}, Payload: []byte{1}}
+				if err := tw.writeRTP(p.source, pkt, 0); err != nil {
+					t.Fatalf("%s: %s", tt.name, err)
+				}
+			}
+		}
+		taps.remove("test")
+		var out []rtp.Header
+		for pkt := range tap {
+			out = append(out, pkt.Header)
+		}
+		if len(out) != tt.want {
+			t.Errorf("%s: %d packets written, want %d", tt.name, len(out), tt.want)
+		}
+		checkContinuous(t, tt.name, out)
+	}
+}
@@ -0,0 +1,327 @@
+'use strict';
+
+var loc = window.location, ws_uri;
+if (loc.protocol === "https:") {
+	ws_uri = "wss:";
+} else {
+	ws_uri = "ws:";
+}
+ws_uri += "//" + loc.host;
+var path = loc.pathname.substring(0, loc.pathname.lastIndexOf("/"));
+ws_uri += path + "/api/admin/ws";
+
+var ws;
+
+var error = (...msgs) => {
+	console.log(...msgs)
+	var errorEle = document.getElementById('errors');
+	msgs.forEach(m => {
+			let c = document.createElement("div");
+			c.classList.add('error');
+			c.innerText = m;
+			errorEle.appendChild(c);
+	})
+	errorEle.classList.remove('hidden');
+}
+var msg = m => {
+	let d = new Date(Date.now()).toISOString();
+	let msgEle = document.getElementById('message-log');
+	msgEle.prepend(d + ' ' + m + '\n');
+}
+
+var wsSend = m => {
+	if (ws && ws.readyState === WebSocket.OPEN) {
+		ws.send(JSON.stringify(m));
+	}
+}
+
+// channels whose listener list is expanded, kept open across updates
+var expanded = new Set();
+
+var adminPassword;
+
+var showAuth = () => {
+	document.getElementById('admin-channels').classList.add('hidden');
+	document.getElementById('admin-auth').classList.remove('hidden');
+}
+
+var connect = password => {
+	ws = new WebSocket(ws_uri);
+	let authorized = false;
+	ws.onopen = () => {
+		msg("ws: connection open");
+		wsSend({Key: 'auth', Value: password});
+	};
+	ws.onclose = () => {
+		msg("ws: connection closed");
+		if (authorized) {
+			error("Connection to the server was lost, reload the page to reconnect");
+		}
+	};
+	ws.onmessage = e => {
+		let m = JSON.parse(e.data);
+		switch (m.Key) {
+			case 'auth_ok':
+				authorized = true;
+				adminPassword = password;
+				sessionStorage.setItem('adminPassword', password);
+				document.getElementById('admin-auth').classList.add('hidden');
+				document.getElementById('admin-channels').classList.remove('hidden');
+				break;
+			case 'channels':
+				updateChannels(m.Value || []);
+				break;
+			case 'error':
+				error(m.Value);
+				if (!authorized) {
+					sessionStorage.removeItem('adminPassword');
+					showAuth();
+				}
+				break;
+		}
+	};
+}
+
+document.getElementById('admin-auth').addEventListener('submit', e => {
+	e.preventDefault();
+	document.getElementById('errors').innerHTML = '';
+	document.getElementById('errors').classList.add('hidden');
+	connect(document.getElementById('admin-password').value);
+});
+
+var sendCmd = (key, cmd) => {
+	msg(key + ' ' + JSON.stringify(cmd));
+	wsSend({Key: key, Value: cmd});
+}
+
+var el = (tag, text, className) => {
+	let e = document.createElement(tag);
+	if (text !== undefined) {
+		e.innerText = text;
+	}
+	if (className) {
+		e.className = className;
+	}
+	return e;
+}
+
+var button = (text, onclick) => {
+	let b = el('button', text, 'button');
+	b.addEventListener('click', onclick);
+	return b;
+}
+
+var since = t => {
+	let secs = Math.floor((Date.now() - new Date(t)) / 1000);
+	let h = Math.floor(secs / 3600), m = Math.floor(secs / 60) % 60, s = secs % 60;
+	return (h > 0 ? h + 'h' : '') + (h > 0 || m > 0 ? m + 'm' : '') + s + 's';
+}
+
+var iceState = state => {
+	return el('span', state || 'unknown', 'ice-state ice-' + (state || 'unknown'));
+}
+
+var publisherCell = (channel, p, label) => {
+	let d = el('div', '', 'publisher');
+	if (!p) {
+		d.innerText = label ? '' : '—';
+		return d;
+	}
+	if (label) {
+		d.appendChild(el('b', label + ': '));
+	}
+	d.appendChild(el('span', p.Addr + ' for ' + since(p.ConnectedAt) + ' '));
+	d.appendChild(iceState(p.Disconnected ? 'reconnecting' : p.ICEState));
+	d.appendChild(button('Kick', () => {
+		if (confirm('Disconnect the publisher of channel ' + channel.Name + '?')) {
+			sendCmd('kick_publisher', {Channel: channel.Name, ID: p.ID});
+		}
+	}));
+	return d;
+}
+
+// talkback sends our microphone privately to a channel's publisher, over its own websocket
+// and peer connection. The table shows it on the next update
+var talk;
+
+var stopTalk = () => {
+	if (!talk) {
+		return;
+	}
+	talk.ws.close();
+	if (talk.pc) {
+		talk.pc.close();
+	}
+	talk.stream.getTracks().forEach(t => t.stop());
+	talk = null;
+}
+
+var startTalk = channelName => {
+	stopTalk();
+	navigator.mediaDevices.getUserMedia({audio: true, video: false}).then(stream => {
+		let t = {channel: channelName, stream: stream};
+		t.ws = new WebSocket(ws_uri.replace(/\/api\/admin\/ws$/, '/ws'));
+		talk = t;
+		let send = m => t.ws.send(JSON.stringify(m));
+		t.ws.onclose = () => {
+			if (talk === t) {
+				stopTalk();
+			}
+		};
+		t.ws.onmessage = e => {
+			let m = JSON.parse(e.data);
+			switch (m.Key) {
+				case 'ice_servers':
+					t.pc = new RTCPeerConnection({iceServers: m.Value});
+					t.pc.onicecandidate = e => {
+						if (e.candidate) {
+							send({Key: 'ice_candidate', Value: e.candidate});
+						}
+					};
+					t.pc.addTransceiver(stream.getAudioTracks()[0], {direction: 'sendonly'});
+					t.pc.createOffer().then(d => {
+						t.pc.setLocalDescription(d);
+						send({Key: 'session_talkback', Value: d});
+					}).catch(error);
+					break;
+				case 'sd_answer':
+					t.pc.setRemoteDescription({type: 'answer', sdp: m.Value});
+					send({Key: 'connect_talkback', Value: {Channel: channelName, Password: adminPassword}});
+					break;
+				case 'ice_candidate':
+					t.pc.addIceCandidate(m.Value);
+					break;
+				case 'talkback_started':
+					msg('talking to the publisher of ' + m.Value);
+					break;
+				case 'error':
+					error('talkback: ' + m.Value);
+					break;
+			}
+		};
+	}).catch(e => error('talkback: ' + e));
+}
+
+var levelCell = channel => {
+	let td = el('td');
+	let al = channel.AudioLevel;
+	if (!al) {
+		return td;
+	}
+	if (al.HasLevel) {
+		let m = el('meter');
+		m.min = -127;
+		m.max = 0;
+		m.low = -60;
+		m.high = -10;
+		m.value = al.Level;
+		m.title = al.Level.toFixed(0) + ' dBov';
+		td.appendChild(m);
+	}
+	if (al.Silent) {
+		td.appendChild(el('div', 'silent ' + (al.SilentSince ? since(al.SilentSince) : ''), 'silent'));
+	}
+	return td;
+}
+
+var listenersCell = channel => {
+	let td = el('td');
+	let subs = channel.Subscribers || [];
+	let connected = subs.filter(s => s.ICEState === 'connected' || s.ICEState === 'completed').length;
+	let details = el('details');
+	details.open = expanded.has(channel.Name);
+	details.addEventListener('toggle', () => {
+		details.open ? expanded.add(channel.Name) : expanded.delete(channel.Name);
+	});
+	let summary = el('summary', subs.length + ' (' + connected + ' connected)');
+	details.appendChild(summary);
+	let ul = el('ul', undefined, 'subscribers');
+	subs.forEach(s => {
+		let li = el('li');
+		li.appendChild(el('span', s.Addr + ' for ' + since(s.ConnectedAt) + ' '));
+		li.appendChild(iceState(s.ICEState));
+		li.appendChild(button('Kick', () => {
+			sendCmd('kick_subscriber', {Channel: channel.Name, ID: s.ID});
+		}));
+		ul.appendChild(li);
+	});
+	details.appendChild(ul);
+	td.appendChild(details);
+	return td;
+}
+
+// rebuilding the table under the pointer would swallow button clicks, so updates wait
+// until the button is released
+var pointerDown = false, pending;
+document.getElementById('admin-channels').addEventListener('pointerdown', () => {
+	pointerDown = true;
+});
+document.addEventListener('pointerup', () => {
+	pointerDown = false;
+	if (pending) {
+		setTimeout(() => renderChannels(pending), 0);
+	}
+});
+
+function updateChannels(channels) {
+	pending = channels;
+	if (!pointerDown) {
+		renderChannels(channels);
+	}
+}
+
+function renderChannels(channels) {
+	pending = null;
+	let tbody = document.querySelector('#admin-channels tbody');
+	tbody.innerHTML = '';
+	document.getElementById('nochannels').classList.toggle('hidden', channels.length > 0);
+	channels.forEach(channel => {
+		let tr = el('tr');
+		let name = el('td');
+		name.appendChild(el('b', channel.Name));
+		if (channel.Title || channel.Language) {
+			name.appendChild(el('div', [channel.Title, channel.Language].filter(Boolean).join(' · ')));
+		}
+		if (channel.Locked) {
+			name.appendChild(el('div', 'locked', 'badge'));
+		}
+		if (channel.Muted) {
+			name.appendChild(el('div', 'muted', 'badge'));
+		}
+		tr.appendChild(name);
+
+		let pub = el('td');
+		pub.appendChild(publisherCell(channel, channel.Publisher));
+		if (channel.Standby) {
+			pub.appendChild(publisherCell(channel, channel.Standby, 'Standby'));
+		}
+		tr.appendChild(pub);
+
+		tr.appendChild(levelCell(channel));
+		tr.appendChild(listenersCell(channel));
+
+		let actions = el('td');
+		if (talk && talk.channel === channel.Name) {
+			actions.appendChild(button('Stop talking', stopTalk));
+		} else if (channel.Publisher && channel.Publisher.Talkback) {
+			actions.appendChild(el('div', 'talkback', 'badge talkback'));
+		} else if (channel.Publisher) {
+			actions.appendChild(button('Talk', () => startTalk(channel.Name)));
+		}
+		actions.appendChild(button(channel.Muted ? 'Unmute' : 'Mute', () => {
+			sendCmd('mute', {Channel: channel.Name, Muted: !channel.Muted});
+		}));
+		actions.appendChild(button(channel.Locked ? 'Unlock' : 'Lock', () => {
+			sendCmd('lock', {Channel: channel.Name, Locked: !channel.Locked});
+		}));
+		tr.appendChild(actions);
+		tbody.appendChild(tr);
+	});
+}
+
+var savedPassword = sessionStorage.getItem('adminPassword');
+if (savedPassword) {
+	connect(savedPassword);
+} else {
+	showAuth();
+}
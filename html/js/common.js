@@ -52,6 +52,13 @@ msg = m => {
 	msgEle.prepend(d + ' ' + m + '\n');
 }
 
+// show how many listeners the channel has
+var updateSubscriberCount = count => {
+	let countEle = document.getElementById('subscriber-count');
+	countEle.innerText = count == 1 ? '1 listener' : count + ' listeners';
+	countEle.classList.remove('hidden');
+}
+
 var wsSend = m => {
 	let j = JSON.stringify(m);
 	if (ws.readyState === WebSocket.OPEN) {
@@ -72,14 +79,27 @@ ws.onopen = function() {
 // -------- WebRTC ------------
 //
 
-var pc = new RTCPeerConnection({
+// ICE servers are set once the server has sent them, see setICEServers
+var pc = new RTCPeerConnection()
+
+// array of funcs to call when ICE servers are set
+var onICEServersReady = [];
+var iceServersReady = false;
+
+// the server sends the STUN/TURN servers to use, so that both sides use the same ones
+var setICEServers = servers => {
+	debug("webrtc: set ice servers")
+	pc.setConfiguration({iceServers: servers});
+	iceServersReady = true;
+	onICEServersReady.forEach(f => {
+		f()
+	})
+}
 
-	iceServers: [
-		{
-			urls: 'stun:stun.l.google.com:19302'
-		}
-	]
-})
+// call f once ICE servers are set, so that candidates are gathered from the right servers
+var whenICEServersReady = f => {
+	iceServersReady ? f() : onICEServersReady.push(f)
+}
 
 pc.oniceconnectionstatechange = e => {
 	debug("ICE state:", pc.iceConnectionState)
@@ -105,12 +125,53 @@ var startSession = sd => {
 	document.getElementById('spinner').classList.remove('hidden');
 	try {
 		debug("webrtc: set remote description")
-		pc.setRemoteDescription(new RTCSessionDescription({type: 'answer', sdp: sd}));
+		pc.setRemoteDescription(new RTCSessionDescription({type: 'answer', sdp: sd})).then(() => {
+			sessionEstablished = true;
+		});
 	} catch (e) {
 		alert(e);
 	}
 }
 
+// once the session is established either side may renegotiate it, e.g. to add a track. If both
+// offer at once the server's offer wins, so ours is rolled back and made again afterwards
+var sessionEstablished = false;
+
+var renegotiate = () => {
+	if (!sessionEstablished) {
+		return;
+	}
+	debug("webrtc: renegotiate");
+	pc.setLocalDescription().then(() => {
+		wsSend({Key: 'renegotiate_offer', Value: pc.localDescription.sdp});
+	}).catch(debug);
+}
+
+pc.onnegotiationneeded = renegotiate;
+
+var handleRenegotiateOffer = sdp => {
+	// setting a remote offer rolls back any offer of ours still awaiting an answer
+	pc.setRemoteDescription({type: 'offer', sdp: sdp})
+		.then(() => pc.setLocalDescription())
+		.then(() => {
+			wsSend({Key: 'renegotiate_answer', Value: pc.localDescription.sdp});
+		})
+		.catch(debug);
+}
+
+var handleRenegotiateAnswer = sdp => {
+	pc.setRemoteDescription({type: 'answer', sdp: sdp}).catch(debug);
+}
+
+// the server couldn't apply our offer or answer. An offer is rolled back; after an answer the
+// server sends its offer again
+var handleRenegotiateError = msg => {
+	debug("webrtc: renegotiation failed: " + msg);
+	if (pc.signalingState === 'have-local-offer') {
+		pc.setLocalDescription({type: 'rollback'}).catch(debug);
+	}
+}
+
 pc.onicecandidate = e => {
 	if (e.candidate && e.candidate.candidate !== "") {
 		let val = {Key: 'ice_candidate', Value: e.candidate};
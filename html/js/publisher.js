@@ -26,14 +26,89 @@ document.getElementById('input-form').addEventListener('submit', function(e) {
 
 	params.Channel = document.getElementById('channel').value;
 	params.Password = document.getElementById('password').value;
+	// resume token from a previous session on this channel, lets us take the channel back
+	// without subscribers being dropped
+	params.ResumeToken = sessionStorage.getItem('resume_token:' + params.Channel) || '';
+	params.Standby = document.getElementById('standby').checked;
+	params.Title = document.getElementById('title').value;
+	params.Language = document.getElementById('language').value;
+	params.Description = document.getElementById('description').value;
+	params.Weight = parseInt(document.getElementById('weight').value) || 0;
 	let val = {Key: 'connect_publisher', Value: params};
 	wsSend(val);
+	// the channel list for choosing a source to listen to
+	wsSend({Key: 'watch_channels'});
 });
 
+document.getElementById('hand-over').addEventListener('click', function() {
+	let val = {Key: 'hand_over'};
+	wsSend(val);
+});
+
+// listen to another channel while we publish e.g. the floor we are interpreting
+var listenSource = function() {
+	let params = {
+		Channel: document.getElementById('source-channel').value,
+		Password: document.getElementById('source-password').value,
+	};
+	debug("listen_source " + params.Channel);
+	wsSend({Key: 'listen_source', Value: params});
+}
+document.getElementById('source-channel').addEventListener('change', listenSource);
+document.getElementById('source-password').addEventListener('change', listenSource);
+
+var updateSourceChannels = function(channels) {
+	let select = document.getElementById('source-channel');
+	let own = document.getElementById('channel').value;
+	let selected = select.value;
+	select.querySelectorAll('option:not([value=""])').forEach(o => o.remove());
+	(channels || []).forEach(c => {
+		if (c.Name === own) {
+			return;
+		}
+		let o = document.createElement('option');
+		o.value = c.Name;
+		o.innerText = c.Title ? c.Title + ' (' + c.Name + ')' : c.Name;
+		select.appendChild(o);
+	});
+	select.value = selected;
+	if (select.value !== selected) {
+		select.value = '';
+	}
+}
+
+var resetSource = function() {
+	document.getElementById('source-channel').value = '';
+}
+
+pc.ontrack = function(e) {
+	let stream = e.streams[0] || new MediaStream([e.track]);
+	// an operator talking privately to us, added by renegotiation
+	if (stream.id === 'talkback') {
+		document.getElementById('talkback-audio').srcObject = stream;
+		return;
+	}
+	// the server only sends audio once we choose a channel to listen to
+	document.getElementById('source-audio').srcObject = stream;
+	document.getElementById('source').classList.remove('hidden');
+}
+
+
+// show whether we are on air or on standby
+var updatePublisherState = function(active) {
+	let stateEle = document.getElementById('publisher-state');
+	stateEle.innerText = active ? 'On air' : 'Standby';
+	stateEle.classList.remove('hidden');
+	document.getElementById('hand-over').classList.toggle('hidden', !active);
+}
+
 ws.onmessage = function (e)	{
 	let wsMsg = JSON.parse(e.data);
 	if( 'Key' in wsMsg ) {
 		switch (wsMsg.Key) {
+			case 'ice_servers':
+				setICEServers(wsMsg.Value);
+				break;
 			case 'info':
 				debug("server info: " + wsMsg.Value);
 				break;
@@ -51,6 +126,38 @@ ws.onmessage = function (e)	{
 			case 'password_required':
 				document.getElementById('password-form').classList.remove('hidden');
 				break;
+			case 'publisher_active':
+				updatePublisherState(wsMsg.Value);
+				break;
+			case 'subscriber_count':
+				updateSubscriberCount(wsMsg.Value);
+				break;
+			case 'channels':
+				updateSourceChannels(wsMsg.Value);
+				break;
+			case 'renegotiate_offer':
+				handleRenegotiateOffer(wsMsg.Value);
+				break;
+			case 'renegotiate_answer':
+				handleRenegotiateAnswer(wsMsg.Value);
+				break;
+			case 'renegotiate_error':
+				handleRenegotiateError(wsMsg.Value);
+				break;
+			case 'talkback':
+				document.getElementById('talkback-state').classList.toggle('hidden', !wsMsg.Value);
+				break;
+			case 'source_closed':
+				debug("source channel closed: " + wsMsg.Value);
+				resetSource();
+				break;
+			case 'source_error':
+				error("can't listen to channel", wsMsg.Value);
+				resetSource();
+				break;
+			case 'resume_token':
+				sessionStorage.setItem('resume_token:' + document.getElementById('channel').value, wsMsg.Value);
+				break;
 		}
 	}
 };
@@ -117,8 +224,8 @@ navigator.mediaDevices.getUserMedia(constraints).then(stream => {
 			wsSend(val);
 		}).catch(debug)
 	}
-	// create offer if WS is ready, otherwise queue 
-	ws.readyState == WebSocket.OPEN ? f() : onWSReady.push(f)
+	// create offer once the server has sent ICE servers, otherwise queue
+	whenICEServersReady(f)
 
 }).catch(debug)
 
@@ -1,34 +1,88 @@
 
-var getChannelsId = setInterval(function() {
-	debug("get_channels");
-	let val = {Key: 'get_channels'}
+// ask the server to push the channel list to us now, and whenever it changes
+let watchChannels = () => {
+	debug("watch_channels");
+	let val = {Key: 'watch_channels'}
 	wsSend(val);
-}, 1000);
+}
+ws.readyState == WebSocket.OPEN ? watchChannels() : onWSReady.push(watchChannels)
 
 document.getElementById('reload').addEventListener('click', function() {
 	window.location.reload(false);
 });
 
-function channelClick(e) {
+// a share link can name a channel to join and a token for private channels
+var linkParams = new URLSearchParams(window.location.search);
+
+// the channel we are listening to. Once connected, picking another channel switches to it
+// on the same connection
+var currentChannel = null;
+var lastChannels = [];
+
+var connectSubscriber = (channel, password) => {
 	document.getElementById('output').classList.remove('hidden');
-	document.getElementById('channels').classList.add('hidden');
+	document.getElementById('channels').classList.remove('hidden');
+	document.getElementById('listener-auth').classList.add('hidden');
+	if (channel === currentChannel) {
+		return;
+	}
 	let params = {};
-	params.Channel = e.target.innerText;
+	params.Channel = channel;
+	params.Password = password || '';
+	if (linkParams.get('channel') === channel) {
+		params.Token = linkParams.get('token') || '';
+	}
+	if (currentChannel) {
+		wsSend({Key: 'switch_channel', Value: params});
+		return;
+	}
+	currentChannel = channel;
+	updateChannels(lastChannels);
 	let val = {Key: 'connect_subscriber', Value: params};
 	wsSend(val);
-};
+}
+
+// private channel, prompt for the listener password
+var listenerAuthRequired = channel => {
+	if (channel === currentChannel) {
+		// we weren't connected after all
+		currentChannel = null;
+	}
+	document.getElementById('output').classList.add('hidden');
+	document.getElementById('listener-auth-channel').innerText = channel;
+	document.getElementById('listener-auth').classList.remove('hidden');
+}
+
+document.getElementById('listener-auth').addEventListener('submit', function(e) {
+	e.preventDefault();
+	connectSubscriber(document.getElementById('listener-auth-channel').innerText, document.getElementById('listener-password').value);
+});
 
 function updateChannels(channels) {
+	lastChannels = channels;
 	let channelsEle = document.querySelector('#channels ul');
 	channelsEle.innerHTML = '';
+	document.getElementById('nochannels').classList.toggle('hidden', channels.length > 0);
 	if(channels.length > 0) {
-		clearInterval(getChannelsId);
-		document.getElementById('nochannels').classList.add('hidden');
 		channels.forEach((e) => {
 			let c = document.createElement("li");
 			c.classList.add('channel');
-			c.innerText = e;
-			c.addEventListener("click", channelClick);
+			c.classList.toggle('current', e.Name === currentChannel);
+			let title = document.createElement("div");
+			title.classList.add('channel-title');
+			title.innerText = e.Title || e.Name;
+			if (e.Language) {
+				title.innerText += ' (' + e.Language + ')';
+				title.lang = e.Language;
+			}
+			c.appendChild(title);
+			if (e.Description) {
+				let desc = document.createElement("div");
+				desc.classList.add('channel-description');
+				desc.innerText = e.Description;
+				c.appendChild(desc);
+			}
+			c.addEventListener("click", () => connectSubscriber(e.Name));
 			channelsEle.appendChild(c);
 		});
 	}
@@ -38,6 +92,9 @@ ws.onmessage = function (e)	{
 	let wsMsg = JSON.parse(e.data);
 	if( 'Key' in wsMsg ) {
 		switch (wsMsg.Key) {
+			case 'ice_servers':
+				setICEServers(wsMsg.Value);
+				break;
 			case 'info':
 				debug("server info: " + wsMsg.Value);
 				break;
@@ -49,17 +106,43 @@ ws.onmessage = function (e)	{
 			case 'sd_answer':
 				startSession(wsMsg.Value);
 				break;
+			case 'renegotiate_offer':
+				handleRenegotiateOffer(wsMsg.Value);
+				break;
+			case 'renegotiate_answer':
+				handleRenegotiateAnswer(wsMsg.Value);
+				break;
+			case 'renegotiate_error':
+				handleRenegotiateError(wsMsg.Value);
+				break;
 			case 'channels':
 				updateChannels(wsMsg.Value);
 				break;
 			case "session_received": // wait for the message that session_subscriber was received
-				document.getElementById("channels").classList.remove("hidden");
 				document.getElementById('reload').classList.remove('hidden');
 				document.getElementById("spinner").classList.add("hidden");
+				if (linkParams.get('channel')) {
+					connectSubscriber(linkParams.get('channel'));
+				} else {
+					document.getElementById("channels").classList.remove("hidden");
+				}
+				break;
+			case 'listener_auth_required':
+				listenerAuthRequired(wsMsg.Value);
 				break;
 			case 'ice_candidate':
 				pc.addIceCandidate(wsMsg.Value)
 				break;
+			case 'subscriber_count':
+				updateSubscriberCount(wsMsg.Value);
+				break;
+			case 'channel_switched':
+				currentChannel = wsMsg.Value;
+				updateChannels(lastChannels);
+				break;
+			case 'switch_error':
+				error("can't switch channel:", wsMsg.Value);
+				break;
 			case 'channel_closed':
 				error("channel '" + wsMsg.Value + "' closed by server")
 				break;
@@ -71,7 +154,6 @@ ws.onclose = function()	{
 	error("websocket connection closed");
 	pc.close()
 	document.getElementById('media').classList.add('hidden')
-	clearInterval(getChannelsId);
 };
 
 //
@@ -99,7 +181,7 @@ let f = () => {
 		wsSend(val);
 	}).catch(debug)
 }
-// create offer if WS is ready, otherwise queue 
-ws.readyState == WebSocket.OPEN ? f() : onWSReady.push(f)
+// create offer once the server has sent ICE servers, otherwise queue
+whenICEServersReady(f)
 
 // ----------------------------------------------------------------
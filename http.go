@@ -21,6 +21,7 @@ import (
 	"net/http"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 	"github.com/pion/webrtc/v4"
 )
@@ -39,8 +40,14 @@ type wsMsg struct {
 }
 
 type CmdConnect struct {
-	Channel  string
-	Password string
+	Channel     string
+	Password    string
+	ResumeToken string
+	Standby     bool
+	// Token is a signed listener token, an alternative to Password for private channels
+	Token string
+	// ChannelMeta describes the channel a publisher opens
+	ChannelMeta
 }
 
 func wsHandler(w http.ResponseWriter, r *http.Request) {
@@ -51,21 +58,27 @@ func wsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	clientAddress := gconn.RemoteAddr().String()
-	xFwdIP := r.Header.Get("X-Forwarded-For")
-	if xFwdIP != "" {
-		clientAddress += " (" + xFwdIP + ")"
-	}
-
 	c := NewConn(gconn)
+	c.addr = clientAddress(r)
 	defer c.Close()
-	c.peer, err = NewWebRTCPeer()
+	metricWSConnections.Inc()
+	metricWSConnectionsActive.Inc()
+	defer metricWSConnectionsActive.Dec()
+	// the client and server use the same ICE servers
+	iceServers := ICEServers(uuid.NewString())
+	c.peer, err = NewWebRTCPeer(iceServers)
 	if err != nil {
 		c.logger.Error("NewWebRTCPeer error", "err", err.Error())
 		return
 	}
 
-	c.logger.Info("client connected", "addr", clientAddress)
+	c.logger.Info("client connected", "addr", clientAddress(r))
+
+	j, _ := json.Marshal(iceServers)
+	if err := c.writeMsg(wsMsg{Key: "ice_servers", Value: j}); err != nil {
+		c.logger.Error("writemsg error", "err", err.Error())
+		return
+	}
 
 	// setup ping/pong to keep connection open
 	pingCh := time.Tick(PingInterval)
@@ -93,6 +106,7 @@ func wsHandler(w http.ResponseWriter, r *http.Request) {
 			err = json.Unmarshal(raw, &msg)
 			if err != nil {
 				c.logger.Error(err.Error())
+				metricSignalingErrors.WithLabelValues("invalid").Inc()
 				return
 			}
 			wsInMsg <- msg
@@ -104,6 +118,7 @@ func wsHandler(w http.ResponseWriter, r *http.Request) {
 		case msg := <-wsInMsg:
 			err = c.handleWSMsg(msg)
 			if err != nil {
+				metricSignalingErrors.WithLabelValues(msg.Key).Inc()
 				j, _ := json.Marshal(err.Error())
 				m := wsMsg{Key: "error", Value: j}
 				err = c.writeMsg(m)
@@ -129,6 +144,36 @@ func wsHandler(w http.ResponseWriter, r *http.Request) {
 				c.logger.Error("writemsg error", "err", err.Error())
 				return
 			}
+		case channels := <-c.channelsChan:
+			j, err := json.Marshal(channels)
+			if err != nil {
+				c.logger.Error("marshal error", "err", err.Error())
+				return
+			}
+			err = c.writeMsg(wsMsg{Key: "channels", Value: j})
+			if err != nil {
+				c.logger.Error("writemsg error", "err", err.Error())
+				return
+			}
+		case count := <-c.countChan:
+			j, _ := json.Marshal(count)
+			err = c.writeMsg(wsMsg{Key: "subscriber_count", Value: j})
+			if err != nil {
+				c.logger.Error("writemsg error", "err", err.Error())
+				return
+			}
+		case track := <-c.talkbackChan():
+			// not fatal, the publisher stays on air
+			if err := c.setTalkback(track); err != nil {
+				c.logger.Error("talkback error", "err", err)
+			}
+		case active := <-c.activeChan():
+			j, _ := json.Marshal(active)
+			err = c.writeMsg(wsMsg{Key: "publisher_active", Value: j})
+			if err != nil {
+				c.logger.Error("writemsg error", "err", err.Error())
+				return
+			}
 		case <-pingCh:
 			err := c.wsConn.WriteControl(websocket.PingMessage, []byte{}, time.Now().Add(WriteWait))
 			if err != nil {
@@ -170,6 +215,12 @@ func (c *Conn) handleWSMsg(msg wsMsg) error {
 			c.logger.Error(err.Error())
 			return err
 		}
+	case "watch_channels":
+		// push the list of channels to the client now, and whenever it changes
+		if c.channelsChan == nil {
+			c.watchID = uuid.NewString()
+			c.channelsChan = reg.WatchChannels(c.watchID)
+		}
 	case "session_subscriber":
 		// subscriber session is only partially setup here as we have to wait for
 		// channel selection to complete the setup
@@ -201,7 +252,7 @@ func (c *Conn) handleWSMsg(msg wsMsg) error {
 			c.logger.Error("setupSession error", "err", err)
 			return err
 		}
-		if publisherPassword != "" {
+		if channelConfigs.PublisherPasswordRequired() {
 			m := wsMsg{Key: "password_required"}
 			err = c.writeMsg(m)
 			if err != nil {
@@ -215,11 +266,120 @@ func (c *Conn) handleWSMsg(msg wsMsg) error {
 		if err != nil {
 			return err
 		}
-		err := c.connectPublisher(cmd)
+		p, err := c.connectPublisher(cmd)
 		if err != nil {
 			c.logger.Error("connectPublisher error", "err", err)
 			return err
 		}
+		c.countChan = p.CountChan
+		j, _ := json.Marshal(p.ResumeToken)
+		err = c.writeMsg(wsMsg{Key: "resume_token", Value: j})
+		if err != nil {
+			c.logger.Error(err.Error())
+			return err
+		}
+	case "session_talkback":
+		var offer webrtc.SessionDescription
+		err = json.Unmarshal(msg.Value, &offer)
+		if err != nil {
+			return err
+		}
+		answer, err := c.peer.SetupPublisher(offer, publisherCodecs, c.rtcStateChangeHandler, c.rtcTrackHandlerTalkback, c.onIceCandidate)
+		if err != nil {
+			c.logger.Error("setupSession error", "err", err)
+			return err
+		}
+		j, _ := json.Marshal(answer.SDP)
+		return c.writeMsg(wsMsg{Key: "sd_answer", Value: j})
+	case "connect_talkback":
+		cmd := CmdConnect{}
+		err = json.Unmarshal(msg.Value, &cmd)
+		if err != nil {
+			return err
+		}
+		if err := c.connectTalkback(cmd); err != nil {
+			c.logger.Error("connectTalkback error", "err", err)
+			return err
+		}
+	case "renegotiate_answer":
+		var sdp string
+		err = json.Unmarshal(msg.Value, &sdp)
+		if err != nil {
+			return err
+		}
+		offer, err := c.peer.SetAnswer(sdp)
+		if err != nil {
+			// not fatal, the session carries on as it was and our offer is sent again
+			c.logger.Info("renegotiate answer error", "err", err)
+			j, _ := json.Marshal(err.Error())
+			if err := c.writeMsg(wsMsg{Key: "renegotiate_error", Value: j}); err != nil {
+				return err
+			}
+		}
+		return c.sendOffer(offer)
+	case "renegotiate_offer":
+		var sdp string
+		err = json.Unmarshal(msg.Value, &sdp)
+		if err != nil {
+			return err
+		}
+		answer, err := c.peer.AnswerOffer(sdp)
+		if err != nil {
+			// not fatal, the session carries on as it was
+			c.logger.Info("renegotiate offer error", "err", err)
+			j, _ := json.Marshal(err.Error())
+			return c.writeMsg(wsMsg{Key: "renegotiate_error", Value: j})
+		}
+		if answer == nil {
+			// glare: the client gives way and answers our offer instead
+			c.logger.Debug("client offer collided with ours, ignored")
+			return nil
+		}
+		j, _ := json.Marshal(answer.SDP)
+		return c.writeMsg(wsMsg{Key: "renegotiate_answer", Value: j})
+	case "hand_over":
+		if c.publisher == nil {
+			return fmt.Errorf("not a publisher")
+		}
+		if err := reg.HandOver(c.channelName, c.publisher.ID); err != nil {
+			// not fatal, the publisher stays on air
+			j, _ := json.Marshal(err.Error())
+			return c.writeMsg(wsMsg{Key: "info", Value: j})
+		}
+	case "listen_source":
+		cmd := CmdConnect{}
+		err = json.Unmarshal(msg.Value, &cmd)
+		if err != nil {
+			return err
+		}
+		if err := c.listenSource(cmd); err != nil {
+			// not fatal, the publisher stays on air
+			c.logger.Info("listen source error", "source", cmd.Channel, "err", err)
+			j, _ := json.Marshal(err.Error())
+			return c.writeMsg(wsMsg{Key: "source_error", Value: j})
+		}
+	case "switch_channel":
+		cmd := CmdConnect{}
+		err = json.Unmarshal(msg.Value, &cmd)
+		if err != nil {
+			return err
+		}
+		if err := checkChannelName(cmd.Channel); err != nil {
+			return err
+		}
+		if err := channelConfigs.CheckListener(cmd.Channel, cmd.Password, cmd.Token); err != nil {
+			c.logger.Info("subscriber not authorized", "channel", cmd.Channel, "err", err)
+			j, _ := json.Marshal(cmd.Channel)
+			return c.writeMsg(wsMsg{Key: "listener_auth_required", Value: j})
+		}
+		if err := c.switchChannel(cmd); err != nil {
+			// not fatal, the subscriber stays on their channel
+			c.logger.Info("switch channel error", "channel", cmd.Channel, "err", err)
+			j, _ := json.Marshal(err.Error())
+			return c.writeMsg(wsMsg{Key: "switch_error", Value: j})
+		}
+		j, _ := json.Marshal(cmd.Channel)
+		return c.writeMsg(wsMsg{Key: "channel_switched", Value: j})
 	case "connect_subscriber":
 		cmd := CmdConnect{}
 		err = json.Unmarshal(msg.Value, &cmd)
@@ -227,25 +387,34 @@ func (c *Conn) handleWSMsg(msg wsMsg) error {
 			return err
 		}
 
+		if err := checkChannelName(cmd.Channel); err != nil {
+			return err
+		}
+
+		// private channel: let the client prompt for a password and try again
+		if err := channelConfigs.CheckListener(cmd.Channel, cmd.Password, cmd.Token); err != nil {
+			c.logger.Info("subscriber not authorized", "channel", cmd.Channel, "err", err)
+			j, _ := json.Marshal(cmd.Channel)
+			return c.writeMsg(wsMsg{Key: "listener_auth_required", Value: j})
+		}
+
 		// finish subscriber session setup here
+		c.Lock()
 		c.channelName = cmd.Channel
+		c.Unlock()
 		err = c.setupSessionSubscriber()
 		if err != nil {
 			c.logger.Error("setupSession error", "err", err)
 			return err
 		}
 
-		if cmd.Channel == "" {
-			return fmt.Errorf("channel cannot be empty")
-		}
-		if channelRegexp.MatchString(cmd.Channel) {
-			return fmt.Errorf("channel name must contain only alphanumeric characters")
-		}
-
 		c.logger.Info("setting up subscriber for channel", "channel", c.channelName)
 
-		s := reg.NewSubscriber()
+		s := reg.NewSubscriber(c.addr)
+		c.Lock()
 		c.clientID = s.ID
+		c.countChan = s.CountChan
+		c.Unlock()
 
 		go func() {
 			for {
@@ -253,10 +422,11 @@ func (c *Conn) handleWSMsg(msg wsMsg) error {
 				case <-c.quitchan:
 					return
 				case <-s.QuitChan:
-					j, _ := json.Marshal(c.channelName)
+					// the subscriber may have switched channel since
+					j, _ := json.Marshal(c.currentChannel())
 					m := wsMsg{Key: "channel_closed", Value: j}
 					c.writeMsg(m)
-					close(c.quitchan)
+					c.quit()
 					return
 				}
 			}
@@ -265,6 +435,7 @@ func (c *Conn) handleWSMsg(msg wsMsg) error {
 		if err := reg.AddSubscriber(c.channelName, s); err != nil {
 			return err
 		}
+		reg.SetICEState(c.channelName, s.ID, c.peer.pc.ICEConnectionState())
 	}
 	return nil
 }
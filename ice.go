@@ -0,0 +1,131 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// how long TURN REST API credentials are valid for, if the config doesn't say
+const defaultTURNCredentialTTL = 24 * time.Hour
+
+// ICEServerConfig is a STUN or TURN server from the ICE servers config file
+type ICEServerConfig struct {
+	URLs       []string
+	Username   string
+	Credential string
+	// Secret is a TURN REST API shared secret (e.g. coturn's static-auth-secret). If set,
+	// time-limited credentials are generated for each session in place of Username and Credential
+	Secret string
+	// TTL is how long generated credentials are valid for e.g. "12h"
+	TTL string
+
+	ttl time.Duration
+}
+
+// iceServerConfigs is used by the server's peer connections and sent to web clients,
+// so that both sides use the same servers
+var iceServerConfigs = []*ICEServerConfig{
+	{URLs: []string{"stun:stun.l.google.com:19302"}},
+}
+
+// LoadICEServerConfigs reads a JSON file containing a list of ICE servers e.g.
+//
+//	[{"URLs": ["turn:turn.example.com:3478"], "Username": "user", "Credential": "pass"}]
+//
+// An empty list disables STUN and TURN, leaving only host candidates
+func LoadICEServerConfigs(path string) ([]*ICEServerConfig, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var configs []*ICEServerConfig
+	if err := json.Unmarshal(raw, &configs); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	for _, ic := range configs {
+		if len(ic.URLs) == 0 {
+			return nil, fmt.Errorf("ICE server has no URLs")
+		}
+		ic.ttl = defaultTURNCredentialTTL
+		if ic.TTL != "" {
+			if ic.ttl, err = time.ParseDuration(ic.TTL); err != nil {
+				return nil, fmt.Errorf("ICE server %v TTL: %w", ic.URLs, err)
+			}
+		}
+	}
+	// check that pion accepts the URLs now, rather than on the first connection
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{ICEServers: iceServers(configs, "check")})
+	if err != nil {
+		return nil, fmt.Errorf("ICE server config: %w", err)
+	}
+	pc.Close()
+	return configs, nil
+}
+
+// ICEServers returns the configured ICE servers, with credentials generated for the given
+// user where a TURN REST API secret is configured
+func ICEServers(user string) []webrtc.ICEServer {
+	return iceServers(iceServerConfigs, user)
+}
+
+func iceServers(configs []*ICEServerConfig, user string) []webrtc.ICEServer {
+	servers := make([]webrtc.ICEServer, 0, len(configs))
+	for _, ic := range configs {
+		s := webrtc.ICEServer{URLs: ic.URLs}
+		if ic.Secret != "" {
+			s.Username, s.Credential = turnRESTCredentials(ic.Secret, user, ic.ttl)
+		} else if ic.Username != "" {
+			s.Username = ic.Username
+			s.Credential = ic.Credential
+		}
+		servers = append(servers, s)
+	}
+	return servers
+}
+
+// turnRESTCredentials returns credentials as described in
+// https://datatracker.ietf.org/doc/html/draft-uberti-behave-turn-rest-00
+func turnRESTCredentials(secret string, user string, ttl time.Duration) (username string, credential string) {
+	username = fmt.Sprintf("%d:%s", time.Now().Add(ttl).Unix(), user)
+	mac := hmac.New(sha1.New, []byte(secret))
+	mac.Write([]byte(username))
+	credential = base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	return
+}
+
+// iceServerLinks returns Link header values advertising the ICE servers to WHIP/WHEP clients
+func iceServerLinks(servers []webrtc.ICEServer) []string {
+	links := make([]string, 0)
+	for _, s := range servers {
+		for _, u := range s.URLs {
+			link := fmt.Sprintf("<%s>; rel=\"ice-server\"", u)
+			if credential, ok := s.Credential.(string); ok && s.Username != "" && !strings.HasPrefix(u, "stun") {
+				link += fmt.Sprintf("; username=%q; credential=%q; credential-type=\"password\"", s.Username, credential)
+			}
+			links = append(links, link)
+		}
+	}
+	return links
+}
@@ -0,0 +1,165 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	// how often channels are checked for silence
+	silenceCheckInterval = time.Second
+	// weight given to each new packet's level in the rolling level
+	levelSmoothing = 0.05
+	// the level of digital silence in dBov
+	minAudioLevel = -127
+)
+
+// AudioLevel is a channel's recent audio level
+type AudioLevel struct {
+	// Level is the rolling audio level in dBov, from -127 (silence) to 0 (loudest).
+	// It is only known if the publisher sends the RTP audio level header extension
+	Level    float64
+	HasLevel bool
+	// Silent is set once the channel has been silent for the registry's SilenceTimeout
+	Silent bool
+	// SilentSince is when a silent channel was last heard
+	SilentSince *time.Time `json:",omitempty"`
+}
+
+// levelMeter keeps a channel's rolling audio level, read from the RTP audio level header
+// extension (RFC 6464), and tracks when the channel was last heard
+type levelMeter struct {
+	level     float64
+	hasLevel  bool
+	lastSound time.Time
+	silent    bool
+}
+
+func newLevelMeter() levelMeter {
+	return levelMeter{level: minAudioLevel, lastSound: time.Now()}
+}
+
+// update reads the audio level from the packet, then removes the extension as subscribers
+// may have negotiated a different ID for it. Packets without a level count as sound,
+// so publishers that don't send levels are only silent when they stop sending packets
+func (m *levelMeter) update(pkt *rtp.Packet, extID uint8, threshold float64) {
+	now := time.Now()
+	if extID == 0 {
+		m.lastSound = now
+		return
+	}
+	raw := pkt.GetExtension(extID)
+	if raw == nil {
+		m.lastSound = now
+		return
+	}
+	pkt.DelExtension(extID)
+	var ext rtp.AudioLevelExtension
+	if err := ext.Unmarshal(raw); err != nil {
+		m.lastSound = now
+		return
+	}
+	level := -float64(ext.Level)
+	if !m.hasLevel {
+		m.level = level
+		m.hasLevel = true
+	} else {
+		m.level += (level - m.level) * levelSmoothing
+	}
+	if level > threshold {
+		m.lastSound = now
+	}
+}
+
+// check updates whether the channel is silent, returning true if it has changed
+func (m *levelMeter) check(timeout time.Duration) bool {
+	silent := time.Since(m.lastSound) >= timeout
+	changed := silent != m.silent
+	m.silent = silent
+	return changed
+}
+
+func (m *levelMeter) audioLevel() AudioLevel {
+	al := AudioLevel{Level: m.level, HasLevel: m.hasLevel, Silent: m.silent}
+	if m.silent {
+		lastSound := m.lastSound
+		al.SilentSince = &lastSound
+	}
+	return al
+}
+
+// audioLevelExtensionID returns the ID negotiated for the RTP audio level header extension,
+// or 0 if the publisher doesn't send it
+func audioLevelExtensionID(receiver *webrtc.RTPReceiver) uint8 {
+	for _, ext := range receiver.GetParameters().HeaderExtensions {
+		if ext.URI == sdp.AudioLevelURI {
+			return uint8(ext.ID)
+		}
+	}
+	return 0
+}
+
+// WatchSilence periodically checks whether each channel has been silent for the registry's
+// SilenceTimeout, logging and counting each time a channel goes silent. It never returns
+func (r *Registry) WatchSilence() {
+	for range time.Tick(silenceCheckInterval) {
+		r.Lock()
+		for name, channel := range r.channels {
+			if channel.Publisher == nil {
+				continue
+			}
+			channel.writer.Lock()
+			changed := channel.writer.meter.check(r.SilenceTimeout)
+			al := channel.writer.meter.audioLevel()
+			channel.writer.Unlock()
+			if !changed {
+				continue
+			}
+			if al.Silent {
+				slog.Warn("channel is silent", "channel", name, "since", al.SilentSince.Format(time.TimeOnly))
+				metricSilenceEvents.WithLabelValues(name).Inc()
+			} else {
+				slog.Info("channel is no longer silent", "channel", name)
+			}
+		}
+		r.Unlock()
+	}
+}
+
+// AudioLevels returns the audio level of each channel that has a publisher
+func (r *Registry) AudioLevels() map[string]AudioLevel {
+	r.Lock()
+	defer r.Unlock()
+	levels := make(map[string]AudioLevel, len(r.channels))
+	for name, channel := range r.channels {
+		if channel.Publisher == nil {
+			continue
+		}
+		levels[name] = channel.audioLevel()
+	}
+	return levels
+}
+
+func (channel *Channel) audioLevel() AudioLevel {
+	channel.writer.Lock()
+	defer channel.writer.Unlock()
+	return channel.writer.meter.audioLevel()
+}
@@ -21,17 +21,26 @@ import (
 	"flag"
 	"fmt"
 	"log/slog"
+	"math"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
 	"syscall"
 	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 const httpTimeout = 15 * time.Second
 
 var (
 	publisherPassword = ""
+	channelConfigs    ChannelConfigs
+
+	recordDir    = ""
+	recordRotate time.Duration
 
 	reg *Registry
 )
@@ -39,6 +48,33 @@ var (
 func main() {
 	port := flag.Int("port", 8080, "listen on this port")
 	debug := flag.Bool("debug", false, "enable debug log")
+	flag.StringVar(&recordDir, "record-dir", "", "record each publisher session to Ogg/Opus files in this directory")
+	flag.DurationVar(&recordRotate, "record-rotate", time.Hour, "start a new recording file after this long, 0 to disable")
+	channelsFile := flag.String("channels", "", "JSON file of reserved channels and their publisher passwords")
+	iceServersFile := flag.String("ice-servers", "", "JSON file of STUN/TURN servers, in place of the default public STUN server")
+	listenerToken := flag.String("listener-token", "", "print a listener token for this private channel and exit")
+	listenerTokenTTL := flag.Duration("listener-token-ttl", 24*time.Hour, "how long a token printed by -listener-token is valid for")
+	turnPort := flag.Int("turn-port", 0, "run a built-in TURN/STUN server on this UDP and TCP port, 0 to disable")
+	turnIP := flag.String("turn-ip", "", "IP address the built-in TURN server relays from and advertises (default first non-loopback IPv4 address)")
+	udpPortMin := flag.Uint("udp-port-min", 0, "lowest UDP port used for WebRTC media, 0 for any")
+	udpPortMax := flag.Uint("udp-port-max", 0, "highest UDP port used for WebRTC media, 0 for any")
+	udpMuxPort := flag.Int("udp-mux-port", 0, "share this single UDP port between all WebRTC peers, 0 to disable")
+	tcpMuxPort := flag.Int("tcp-mux-port", 0, "accept ICE-TCP connections from all WebRTC peers on this port, 0 to disable")
+	publicIPs := flag.String("public-ip", "", "comma separated public IPs to advertise in place of local addresses when behind 1:1 NAT, either one IP or public/local pairs")
+	iceInterfaces := flag.String("ice-interfaces", "", "comma separated network interfaces to use for WebRTC, default all")
+	iceNetworks := flag.String("ice-networks", "", "comma separated CIDR ranges of local addresses to use for WebRTC, default all")
+	opusStereo := flag.Bool("opus-stereo", false, "let publishers send stereo audio")
+	opusMaxBitrate := flag.Int("opus-max-bitrate", 0, "ask publishers to encode Opus at no more than this many bits per second (6000-510000), 0 for the browser default")
+	opusFEC := flag.Bool("opus-fec", true, "ask publishers to include Opus forward error correction")
+	opusDTX := flag.Bool("opus-dtx", false, "let publishers send fewer packets during silence")
+	red := flag.Bool("red", false, "allow redundant audio encoding (RED)")
+	nack := flag.Bool("nack", true, "retransmit lost packets when requested")
+	twcc := flag.Bool("twcc", true, "send transport-wide congestion control feedback")
+	pubCodecs := flag.String("publisher-codecs", "opus", "comma separated codecs publishers may use: opus, g722, pcmu, pcma")
+	publisherGrace := flag.Duration("publisher-grace", 0, "keep a channel open for this long after its publisher disconnects, so they can reconnect without dropping subscribers")
+	silenceTimeout := flag.Duration("silence-timeout", 30*time.Second, "report channels that have been silent for this long, 0 to disable")
+	silenceLevel := flag.Float64("silence-level", -60, "audio level in dBov below which a channel counts as silent")
+	mixesFile := flag.String("mixes", "", "JSON file of mix channels, each mixing the audio of other channels")
 	flag.Parse()
 
 	var programLevel = new(slog.LevelVar) // Info by default
@@ -62,7 +98,136 @@ func main() {
 		slog.Info("publisher password set")
 	}
 
+	adminPassword = os.Getenv("ADMIN_PASSWORD")
+
+	if *channelsFile != "" {
+		var err error
+		channelConfigs, err = LoadChannelConfigs(*channelsFile)
+		if err != nil {
+			slog.Error("channels config error", "err", err)
+			os.Exit(1)
+		}
+		slog.Info("reserved channels loaded", "count", len(channelConfigs))
+	}
+
+	if *mixesFile != "" {
+		var err error
+		mixConfigs, err = LoadMixConfigs(*mixesFile, channelConfigs)
+		if err != nil {
+			slog.Error("mixes config error", "err", err)
+			os.Exit(1)
+		}
+		slog.Info("mixes loaded", "count", len(mixConfigs))
+	}
+
+	if *listenerToken != "" {
+		token, err := channelConfigs.NewListenerToken(*listenerToken, *listenerTokenTTL)
+		if err != nil {
+			slog.Error("listener token error", "err", err)
+			os.Exit(1)
+		}
+		fmt.Printf("token: %s\nshare link: subscriber.html?%s\n", token, url.Values{"channel": {*listenerToken}, "token": {token}}.Encode())
+		return
+	}
+
+	if *iceServersFile != "" {
+		var err error
+		iceServerConfigs, err = LoadICEServerConfigs(*iceServersFile)
+		if err != nil {
+			slog.Error("ICE servers config error", "err", err)
+			os.Exit(1)
+		}
+		slog.Info("ICE servers loaded", "count", len(iceServerConfigs))
+	} else if *publicIPs != "" {
+		// the public IPs are already known, so there's no need to discover them via STUN
+		iceServerConfigs = nil
+		slog.Info("public IPs set, default STUN server disabled")
+	}
+
+	// checked here, as they would be truncated to fit the config
+	if *udpPortMin > math.MaxUint16 || *udpPortMax > math.MaxUint16 {
+		slog.Error("WebRTC config error", "err", "UDP ports must be no higher than 65535")
+		os.Exit(1)
+	}
+	if *udpPortMin > *udpPortMax {
+		slog.Error("WebRTC config error", "err", "udp-port-min is higher than udp-port-max")
+		os.Exit(1)
+	}
+	nc := NetworkConfig{
+		UDPPortMin: uint16(*udpPortMin),
+		UDPPortMax: uint16(*udpPortMax),
+		UDPMuxPort: *udpMuxPort,
+		TCPMuxPort: *tcpMuxPort,
+		PublicIPs:  splitList(*publicIPs),
+		Interfaces: splitList(*iceInterfaces),
+		Networks:   splitList(*iceNetworks),
+	}
+
+	if *turnPort != 0 {
+		turnServer, err := StartTURNServer(*turnPort, *turnIP, nc)
+		if err != nil {
+			slog.Error("error starting TURN server", "err", err)
+			os.Exit(1)
+		}
+		defer turnServer.Close()
+		slog.Info("TURN server listening", "port", *turnPort, "urls", iceServerConfigs[len(iceServerConfigs)-1].URLs)
+	}
+	mc := MediaConfig{
+		OpusStereo:            *opusStereo,
+		OpusMaxAverageBitrate: *opusMaxBitrate,
+		OpusInbandFEC:         *opusFEC,
+		OpusDTX:               *opusDTX,
+		RED:                   *red,
+		NACK:                  *nack,
+		TWCC:                  *twcc,
+		PublisherCodecs:       splitList(*pubCodecs),
+	}
+	api, apiCloser, err := NewWebRTCAPI(nc, mc)
+	if err != nil {
+		slog.Error("WebRTC config error", "err", err)
+		os.Exit(1)
+	}
+	defer apiCloser.Close()
+	webrtcAPI = api
+	// already checked by NewWebRTCAPI
+	publisherCodecs, _ = mc.publisherCodecs()
+	mediaConfig = mc
+	if len(nc.PublicIPs) > 0 {
+		slog.Info("advertising public IPs", "ips", nc.PublicIPs)
+	}
+	if nc.UDPMuxPort != 0 {
+		slog.Info("WebRTC UDP mux listening", "port", nc.UDPMuxPort)
+	}
+	if nc.TCPMuxPort != 0 {
+		slog.Info("WebRTC ICE-TCP mux listening", "port", nc.TCPMuxPort)
+	}
+
+	if recordDir != "" {
+		if err := checkRecordDir(recordDir); err != nil {
+			slog.Error("record directory error", "err", err)
+			os.Exit(1)
+		}
+		slog.Info("recording enabled", "dir", recordDir)
+	}
+
 	http.HandleFunc("/ws", wsHandler)
+	http.Handle("/metrics", promhttp.Handler())
+	if adminPassword != "" {
+		http.HandleFunc("GET /api/admin/channels", adminAuth(adminChannelsHandler))
+		http.HandleFunc("DELETE /api/admin/channels/{channel}/publishers/{id}", adminAuth(adminKickPublisherHandler))
+		http.HandleFunc("DELETE /api/admin/channels/{channel}/subscribers/{id}", adminAuth(adminKickSubscriberHandler))
+		http.HandleFunc("PUT /api/admin/channels/{channel}/lock", adminAuth(adminLockHandler))
+		http.HandleFunc("DELETE /api/admin/channels/{channel}/lock", adminAuth(adminUnlockHandler))
+		http.HandleFunc("PUT /api/admin/channels/{channel}/mute", adminAuth(adminMuteHandler))
+		http.HandleFunc("DELETE /api/admin/channels/{channel}/mute", adminAuth(adminMuteHandler))
+		// the dashboard's websocket does its own authentication, as browsers can't set headers on websockets
+		http.HandleFunc("GET /api/admin/ws", adminWSHandler)
+		slog.Info("admin API enabled")
+	}
+	http.HandleFunc("POST /whip/{channel}", whipHandler)
+	http.HandleFunc("DELETE /whip/{channel}/{id}", whipDeleteHandler)
+	http.HandleFunc("POST /whep/{channel}", whepHandler)
+	http.HandleFunc("DELETE /whep/{channel}/{id}", whepDeleteHandler)
 	http.Handle("/", http.FileServer(http.FS(embedContentHtml)))
 
 	slog.Info("listening on port", "port", *port)
@@ -74,6 +239,17 @@ func main() {
 	}
 
 	reg = NewRegistry()
+	prometheus.MustRegister(registryCollector{reg})
+	reg.PublisherGrace = *publisherGrace
+	reg.SilenceTimeout = *silenceTimeout
+	reg.SilenceLevel = *silenceLevel
+	if reg.SilenceTimeout > 0 {
+		go reg.WatchSilence()
+	}
+	if err := StartMixers(reg, mc); err != nil {
+		slog.Error("error starting mixer", "err", err)
+		os.Exit(1)
+	}
 
 	go func() {
 		err := srv.ListenAndServe()
@@ -94,8 +270,17 @@ func main() {
 
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
+	failed := false
 	if err := srv.Shutdown(ctx); err != nil {
 		slog.Error("graceful shutdown failed", "err", err)
+		failed = true
+	}
+	// disconnect publishers so their recordings are finished
+	if err := reg.Shutdown(ctx); err != nil {
+		slog.Error("closing publishers failed", "err", err)
+		failed = true
+	}
+	if failed {
 		os.Exit(1)
 	}
 }
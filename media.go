@@ -0,0 +1,295 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/twcc"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	mimeTypeRED = "audio/red"
+
+	opusPayloadType = 111
+	redPayloadType  = 63
+)
+
+// publisherCodecs are the codecs publishers may use, with our format parameters. They are set
+// along with webrtcAPI, as is mediaConfig
+var publisherCodecs []webrtc.RTPCodecParameters
+
+var mediaConfig MediaConfig
+
+// codecMimeTypes are the codecs that can be allowed for publishers, by name
+var codecMimeTypes = map[string]string{
+	"opus": webrtc.MimeTypeOpus,
+	"g722": webrtc.MimeTypeG722,
+	"pcmu": webrtc.MimeTypePCMU,
+	"pcma": webrtc.MimeTypePCMA,
+}
+
+// MediaConfig controls the audio codecs and RTP features offered to peers
+type MediaConfig struct {
+	// OpusStereo lets publishers send stereo audio
+	OpusStereo bool
+	// OpusMaxAverageBitrate asks publishers to encode at no more than this many bits per second, 0 for the browser default
+	OpusMaxAverageBitrate int
+	// OpusInbandFEC asks publishers to include forward error correction, to cover lost packets
+	OpusInbandFEC bool
+	// OpusDTX lets publishers send fewer packets during silence
+	OpusDTX bool
+	// RED allows redundant audio encoding (RFC 2198), at the cost of extra bandwidth
+	RED bool
+	// NACK enables retransmission of lost packets
+	NACK bool
+	// TWCC enables transport-wide congestion control feedback
+	TWCC bool
+	// PublisherCodecs are the names of the codecs publishers may use e.g. "opus", "pcmu".
+	// RED is allowed along with Opus if enabled
+	PublisherCodecs []string
+}
+
+// opusFmtpLine returns the Opus format parameters sent in SDP answers
+func (mc MediaConfig) opusFmtpLine() string {
+	params := []string{"minptime=10"}
+	if mc.OpusInbandFEC {
+		params = append(params, "useinbandfec=1")
+	}
+	if mc.OpusDTX {
+		params = append(params, "usedtx=1")
+	}
+	if mc.OpusStereo {
+		params = append(params, "stereo=1", "sprop-stereo=1")
+	}
+	if mc.OpusMaxAverageBitrate > 0 {
+		params = append(params, fmt.Sprintf("maxaveragebitrate=%d", mc.OpusMaxAverageBitrate))
+	}
+	return strings.Join(params, ";")
+}
+
+// codecs returns the audio codecs for the config, in order of preference
+func (mc MediaConfig) codecs() []webrtc.RTPCodecParameters {
+	var feedback []webrtc.RTCPFeedback
+	if mc.NACK {
+		feedback = append(feedback, webrtc.RTCPFeedback{Type: webrtc.TypeRTCPFBNACK})
+	}
+	if mc.TWCC {
+		feedback = append(feedback, webrtc.RTCPFeedback{Type: webrtc.TypeRTCPFBTransportCC})
+	}
+	codecs := []webrtc.RTPCodecParameters{{
+		RTPCodecCapability: webrtc.RTPCodecCapability{
+			MimeType:     webrtc.MimeTypeOpus,
+			ClockRate:    48000,
+			Channels:     2,
+			SDPFmtpLine:  mc.opusFmtpLine(),
+			RTCPFeedback: feedback,
+		},
+		PayloadType: opusPayloadType,
+	}}
+	if mc.RED {
+		codecs = append(codecs, webrtc.RTPCodecParameters{
+			RTPCodecCapability: webrtc.RTPCodecCapability{
+				MimeType:    mimeTypeRED,
+				ClockRate:   48000,
+				Channels:    2,
+				SDPFmtpLine: fmt.Sprintf("%d/%d", opusPayloadType, opusPayloadType),
+			},
+			PayloadType: redPayloadType,
+		})
+	}
+	// for hardware encoders and SIP gateways
+	codecs = append(codecs,
+		webrtc.RTPCodecParameters{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeG722, ClockRate: 8000}, PayloadType: 9},
+		webrtc.RTPCodecParameters{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypePCMU, ClockRate: 8000}, PayloadType: 0},
+		webrtc.RTPCodecParameters{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypePCMA, ClockRate: 8000}, PayloadType: 8},
+	)
+	return codecs
+}
+
+// publisherCodecs returns the codecs publishers may use, in order of preference
+func (mc MediaConfig) publisherCodecs() ([]webrtc.RTPCodecParameters, error) {
+	allowed := make(map[string]bool)
+	for _, name := range mc.PublisherCodecs {
+		mimeType, ok := codecMimeTypes[strings.ToLower(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown publisher codec %q", name)
+		}
+		allowed[strings.ToLower(mimeType)] = true
+	}
+	if len(allowed) == 0 {
+		return nil, fmt.Errorf("no publisher codecs allowed")
+	}
+	if allowed[strings.ToLower(webrtc.MimeTypeOpus)] {
+		allowed[mimeTypeRED] = true
+	}
+	var codecs []webrtc.RTPCodecParameters
+	for _, codec := range mc.codecs() {
+		if allowed[strings.ToLower(codec.MimeType)] {
+			codecs = append(codecs, codec)
+		}
+	}
+	return codecs, nil
+}
+
+// offerCodecs returns the names of the audio codecs in an SDP offer e.g. "opus"
+func offerCodecs(offer *webrtc.SessionDescription) ([]string, error) {
+	if offer == nil {
+		return nil, fmt.Errorf("no offer received")
+	}
+	parsed, err := offer.Unmarshal()
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, md := range parsed.MediaDescriptions {
+		if md.MediaName.Media != "audio" {
+			continue
+		}
+		for _, a := range md.Attributes {
+			if a.Key != "rtpmap" {
+				continue
+			}
+			// e.g. 111 opus/48000/2
+			_, encoding, _ := strings.Cut(a.Value, " ")
+			name, _, _ := strings.Cut(encoding, "/")
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// checkOfferCodecs returns an error if the offer has none of the given codecs. RED carries
+// Opus, so it also needs Opus in the offer
+func checkOfferCodecs(offer *webrtc.SessionDescription, codecs []webrtc.RTPCodecParameters) error {
+	names, err := offerCodecs(offer)
+	if err != nil {
+		return err
+	}
+	if len(names) == 0 {
+		return fmt.Errorf("offer has no audio")
+	}
+	has := func(mimeType string) bool {
+		_, name, _ := strings.Cut(mimeType, "/")
+		for _, n := range names {
+			if strings.EqualFold(n, name) {
+				return true
+			}
+		}
+		return false
+	}
+	var wanted []string
+	for _, codec := range codecs {
+		_, name, _ := strings.Cut(codec.MimeType, "/")
+		if strings.EqualFold(codec.MimeType, mimeTypeRED) {
+			if has(mimeTypeRED) && has(webrtc.MimeTypeOpus) {
+				return nil
+			}
+			wanted = append(wanted, name+" with opus")
+			continue
+		}
+		if has(codec.MimeType) {
+			return nil
+		}
+		wanted = append(wanted, name)
+	}
+	return fmt.Errorf("unsupported audio codec: offer has %s, expected %s", strings.Join(names, ", "), strings.Join(wanted, " or "))
+}
+
+// canListenSource returns true if a publisher's offer can receive Opus audio as well as send,
+// so they may listen to another channel while they publish
+func canListenSource(offer *webrtc.SessionDescription) bool {
+	if len(publisherCodecs) == 0 || !strings.EqualFold(publisherCodecs[0].MimeType, webrtc.MimeTypeOpus) {
+		return false
+	}
+	if checkOfferCodecs(offer, publisherCodecs[:1]) != nil {
+		return false
+	}
+	parsed, err := offer.Unmarshal()
+	if err != nil {
+		return false
+	}
+	for _, md := range parsed.MediaDescriptions {
+		if md.MediaName.Media != "audio" {
+			continue
+		}
+		// sendrecv is the default direction
+		for _, dir := range []string{"sendonly", "recvonly", "inactive"} {
+			if _, ok := md.Attribute(dir); ok {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// checkOpusBitrate returns an error if br isn't a valid Opus max average bitrate, or 0 for the default
+func checkOpusBitrate(br int) error {
+	if br != 0 && (br < 6000 || br > 510000) {
+		return fmt.Errorf("Opus max average bitrate must be between 6000 and 510000")
+	}
+	return nil
+}
+
+// newMediaEngine returns a media engine and interceptors for the given config
+func newMediaEngine(mc MediaConfig) (*webrtc.MediaEngine, *interceptor.Registry, error) {
+	if err := checkOpusBitrate(mc.OpusMaxAverageBitrate); err != nil {
+		return nil, nil, err
+	}
+
+	if _, err := mc.publisherCodecs(); err != nil {
+		return nil, nil, err
+	}
+
+	m := &webrtc.MediaEngine{}
+	for _, codec := range mc.codecs() {
+		if err := m.RegisterCodec(codec, webrtc.RTPCodecTypeAudio); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// lets us monitor publishers' audio levels
+	if err := m.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{URI: sdp.AudioLevelURI}, webrtc.RTPCodecTypeAudio); err != nil {
+		return nil, nil, err
+	}
+
+	ir := &interceptor.Registry{}
+	if err := webrtc.ConfigureRTCPReports(ir); err != nil {
+		return nil, nil, err
+	}
+	if mc.NACK {
+		if err := webrtc.ConfigureNack(m, ir); err != nil {
+			return nil, nil, err
+		}
+	}
+	if mc.TWCC {
+		// the transport-cc feedback is already on the codecs, so this is webrtc.ConfigureTWCCSender
+		// without registering it again
+		if err := m.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{URI: sdp.TransportCCURI}, webrtc.RTPCodecTypeAudio); err != nil {
+			return nil, nil, err
+		}
+		generator, err := twcc.NewSenderInterceptor()
+		if err != nil {
+			return nil, nil, err
+		}
+		ir.Add(generator)
+	}
+	return m, ir, nil
+}
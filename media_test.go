@@ -0,0 +1,65 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// testOffer returns an offer with one audio section of the given rtpmap values e.g. "111 opus/48000/2"
+func testOffer(rtpmaps ...string) *webrtc.SessionDescription {
+	sdp := "v=0\r\no=- 0 0 IN IP4 0.0.0.0\r\ns=-\r\nt=0 0\r\nm=audio 9 UDP/TLS/RTP/SAVPF"
+	for _, m := range rtpmaps {
+		pt, _, _ := strings.Cut(m, " ")
+		sdp += " " + pt
+	}
+	sdp += "\r\n"
+	for _, m := range rtpmaps {
+		sdp += "a=rtpmap:" + m + "\r\n"
+	}
+	return &webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: sdp}
+}
+
+func TestCheckOfferCodecs(t *testing.T) {
+	codec := func(mimeType string) []webrtc.RTPCodecParameters {
+		return []webrtc.RTPCodecParameters{{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: mimeType}}}
+	}
+	tests := []struct {
+		name    string
+		offer   *webrtc.SessionDescription
+		codecs  []webrtc.RTPCodecParameters
+		wantErr string
+	}{
+		{"opus", testOffer("111 opus/48000/2"), codec(webrtc.MimeTypeOpus), ""},
+		{"missing", testOffer("0 PCMU/8000"), codec(webrtc.MimeTypeOpus), "expected opus"},
+		{"red channel", testOffer("111 opus/48000/2", "63 red/48000/2"), codec(mimeTypeRED), ""},
+		{"red without red", testOffer("111 opus/48000/2"), codec(mimeTypeRED), "expected red with opus"},
+		{"red without opus", testOffer("63 red/48000/2"), codec(mimeTypeRED), "expected red with opus"},
+		{"any of several", testOffer("9 G722/8000"), append(codec(webrtc.MimeTypeOpus), codec(webrtc.MimeTypeG722)...), ""},
+		{"no audio", &webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: "v=0\r\no=- 0 0 IN IP4 0.0.0.0\r\ns=-\r\nt=0 0\r\n"}, codec(webrtc.MimeTypeOpus), "no audio"},
+	}
+	for _, tt := range tests {
+		err := checkOfferCodecs(tt.offer, tt.codecs)
+		switch {
+		case tt.wantErr == "" && err != nil:
+			t.Errorf("%s: unexpected error %s", tt.name, err)
+		case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+			t.Errorf("%s: error = %v, want %q", tt.name, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	maxTitleLength       = 64
+	maxDescriptionLength = 500
+)
+
+// a well-formed BCP-47 language tag e.g. "es", "pt-BR", "zh-Hant-TW"
+var languageRegexp = regexp.MustCompile(`^[a-zA-Z]{2,8}(-[a-zA-Z0-9]{1,8})*$`)
+
+// ChannelMeta describes a channel to listeners. It is set by the publisher that opens the channel
+type ChannelMeta struct {
+	// Language is the BCP-47 language code of the channel's audio e.g. "es" or "pt-BR"
+	Language string
+	// Title is the channel's display name, in any script e.g. "Español"
+	Title       string
+	Description string
+	// Weight orders the channel list, lowest first. Channels of equal weight are sorted by title
+	Weight int
+}
+
+// ChannelListing is a channel as listed to subscribers
+type ChannelListing struct {
+	// Name is the channel's key, used to connect to it
+	Name string
+	ChannelMeta
+}
+
+// checkChannelMeta returns an error if the metadata isn't fit to show to listeners
+func checkChannelMeta(meta ChannelMeta) error {
+	if meta.Language != "" && !languageRegexp.MatchString(meta.Language) {
+		return fmt.Errorf("language %q is not a BCP-47 language code", meta.Language)
+	}
+	if err := checkMetaText("title", meta.Title, maxTitleLength); err != nil {
+		return err
+	}
+	return checkMetaText("description", meta.Description, maxDescriptionLength)
+}
+
+func checkMetaText(field string, s string, maxLength int) error {
+	if !utf8.ValidString(s) {
+		return fmt.Errorf("channel %s is not valid UTF-8", field)
+	}
+	if utf8.RuneCountInString(s) > maxLength {
+		return fmt.Errorf("channel %s must be at most %d characters", field, maxLength)
+	}
+	if strings.IndexFunc(s, unicode.IsControl) >= 0 {
+		return fmt.Errorf("channel %s must not contain control characters", field)
+	}
+	return nil
+}
+
+// displayTitle returns the channel's title, or its name if it has none
+func (l ChannelListing) displayTitle() string {
+	if l.Title != "" {
+		return l.Title
+	}
+	return l.Name
+}
+
+// sortChannelListings sorts channels by weight, then title, then name
+func sortChannelListings(listings []ChannelListing) {
+	sort.Slice(listings, func(i, j int) bool {
+		a, b := listings[i], listings[j]
+		if a.Weight != b.Weight {
+			return a.Weight < b.Weight
+		}
+		if ta, tb := strings.ToLower(a.displayTitle()), strings.ToLower(b.displayTitle()); ta != tb {
+			return ta < tb
+		}
+		return a.Name < b.Name
+	})
+}
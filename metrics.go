@@ -0,0 +1,109 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	metricPublisherSessionsStarted = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "babelcast_publisher_sessions_started_total",
+		Help: "Publisher sessions started, including standby publishers.",
+	})
+	metricPublisherSessionsEnded = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "babelcast_publisher_sessions_ended_total",
+		Help: "Publisher sessions ended, including standby publishers.",
+	})
+	metricRTPPackets = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "babelcast_rtp_packets_forwarded_total",
+		Help: "RTP packets forwarded to a channel's subscribers.",
+	}, []string{"channel"})
+	metricRTPBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "babelcast_rtp_bytes_forwarded_total",
+		Help: "RTP payload bytes forwarded to a channel's subscribers.",
+	}, []string{"channel"})
+	metricTrackWriteErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "babelcast_local_track_write_errors_total",
+		Help: "Errors writing RTP packets to a channel's local track.",
+	}, []string{"channel"})
+	metricICEStates = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "babelcast_ice_state_transitions_total",
+		Help: "ICE connection state transitions, by new state.",
+	}, []string{"state"})
+	metricWSConnections = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "babelcast_websocket_connections_total",
+		Help: "Websocket connections accepted.",
+	})
+	metricWSConnectionsActive = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "babelcast_websocket_connections_active",
+		Help: "Websocket connections currently open.",
+	})
+	metricSignalingErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "babelcast_signaling_errors_total",
+		Help: "Websocket signaling errors, by message key.",
+	}, []string{"key"})
+	metricSilenceEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "babelcast_silence_events_total",
+		Help: "Times a channel has gone silent for longer than the silence timeout.",
+	}, []string{"channel"})
+)
+
+var (
+	descChannelsActive = prometheus.NewDesc("babelcast_channels_active", "Channels that have a publisher.", nil, nil)
+	descSubscribers    = prometheus.NewDesc("babelcast_subscribers", "Subscribers per channel.", []string{"channel"}, nil)
+	descAudioLevel     = prometheus.NewDesc("babelcast_audio_level_dbov", "Rolling audio level per channel, for publishers that send audio levels.", []string{"channel"}, nil)
+	descSilent         = prometheus.NewDesc("babelcast_channel_silent", "1 if the channel has been silent for longer than the silence timeout.", []string{"channel"}, nil)
+)
+
+// deleteChannelMetrics drops a channel's per-channel counters once its publisher is removed.
+// Anyone can make up a channel name, so series for channels that are gone aren't kept
+func deleteChannelMetrics(channelName string) {
+	metricRTPPackets.DeleteLabelValues(channelName)
+	metricRTPBytes.DeleteLabelValues(channelName)
+	metricTrackWriteErrors.DeleteLabelValues(channelName)
+	metricSilenceEvents.DeleteLabelValues(channelName)
+}
+
+// registryCollector reports the registry's channels and subscribers at scrape time
+type registryCollector struct {
+	reg *Registry
+}
+
+func (rc registryCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- descChannelsActive
+	ch <- descSubscribers
+	ch <- descAudioLevel
+	ch <- descSilent
+}
+
+func (rc registryCollector) Collect(ch chan<- prometheus.Metric) {
+	counts := rc.reg.SubscriberCounts()
+	ch <- prometheus.MustNewConstMetric(descChannelsActive, prometheus.GaugeValue, float64(len(counts)))
+	for name, count := range counts {
+		ch <- prometheus.MustNewConstMetric(descSubscribers, prometheus.GaugeValue, float64(count), name)
+	}
+	for name, al := range rc.reg.AudioLevels() {
+		if al.HasLevel {
+			ch <- prometheus.MustNewConstMetric(descAudioLevel, prometheus.GaugeValue, al.Level, name)
+		}
+		silent := 0.0
+		if al.Silent {
+			silent = 1
+		}
+		ch <- prometheus.MustNewConstMetric(descSilent, prometheus.GaugeValue, silent, name)
+	}
+}
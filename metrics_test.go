@@ -0,0 +1,39 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import "testing"
+
+func TestChannelMetricsDeleted(t *testing.T) {
+	r := NewRegistry()
+	p, err := r.AddPublisher("Metrics", newTrack(t), "", "", "", false, ChannelMeta{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	metricTrackWriteErrors.WithLabelValues("Metrics").Inc()
+	metricSilenceEvents.WithLabelValues("Metrics").Inc()
+
+	r.RemovePublisher("Metrics", p.ID)
+	for name, c := range map[string]interface{ DeleteLabelValues(...string) bool }{
+		"packets":      metricRTPPackets,
+		"bytes":        metricRTPBytes,
+		"write errors": metricTrackWriteErrors,
+		"silence":      metricSilenceEvents,
+	} {
+		if c.DeleteLabelValues("Metrics") {
+			t.Errorf("%s series still present after the publisher was removed", name)
+		}
+	}
+}
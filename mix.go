@@ -0,0 +1,397 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	// mixes are decoded, mixed and encoded as mono 48kHz audio in 20ms frames
+	mixSampleRate    = 48000
+	mixChannels      = 1
+	mixFrameDuration = 20 * time.Millisecond
+	mixFrameSamples  = mixSampleRate / 50
+	// the longest Opus packet is 120ms
+	maxOpusPacketSamples = mixSampleRate * 120 / 1000
+	// audio buffered from each source before it is mixed in, to ride out network jitter
+	mixJitterSamples = 2 * mixFrameSamples
+	// the most audio buffered from a source. Beyond this the oldest is dropped, so that
+	// a source's clock running fast doesn't delay the mix
+	mixMaxBufferedSamples = 10 * mixFrameSamples
+	// the most lost packets in a row that are concealed. A longer gap is left silent
+	mixMaxConcealedPackets = 5
+	// packets further behind than this are taken as the source restarting, not arriving late
+	mixMaxLatePackets = 100
+	// the range of source gains in dB
+	minMixGain = -60
+	maxMixGain = 20
+)
+
+var errOpusUnsupported = errors.New("mixing needs libopus, rebuild with: go build -tags \"opus nolibopusfile\"")
+
+// opusDecoder and opusEncoder are implemented by libopus when built with the opus tag
+type opusDecoder interface {
+	DecodeFloat32(data []byte, pcm []float32) (int, error)
+	// DecodeFECFloat32 recovers the packet before data from its forward error correction, and
+	// DecodePLCFloat32 conceals a lost packet. Both fill pcm up to its capacity
+	DecodeFECFloat32(data []byte, pcm []float32) error
+	DecodePLCFloat32(pcm []float32) error
+}
+
+type opusEncoder interface {
+	EncodeFloat32(pcm []float32, data []byte) (int, error)
+}
+
+// MixSource is a channel whose audio is mixed into a mix channel
+type MixSource struct {
+	Channel string
+	// GainDB is the source's gain in dB e.g. -12 to put the floor quietly under the
+	// interpretation. 0 leaves the source as it is
+	GainDB float64
+}
+
+// MixConfig is a virtual channel that mixes the audio of other channels, from the mixes config file
+type MixConfig struct {
+	Name string
+	// ChannelMeta describes the mix channel to listeners
+	ChannelMeta
+	Sources []MixSource
+}
+
+// mixConfigs holds the mix channels keyed by name. It is read-only once loaded
+var mixConfigs = make(map[string]*MixConfig)
+
+// LoadMixConfigs reads mix channels from a JSON file containing a list of mixes e.g.
+//
+//	[{"Name": "French Floor", "Title": "Français + floor", "Language": "fr",
+//	  "Sources": [{"Channel": "French"}, {"Channel": "Floor", "GainDB": -12}]}]
+//
+// A mix of a private channel must itself be private, so that it doesn't broadcast the channel
+func LoadMixConfigs(path string, channels ChannelConfigs) (map[string]*MixConfig, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var list []*MixConfig
+	if err := json.Unmarshal(raw, &list); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	configs := make(map[string]*MixConfig)
+	for _, mc := range list {
+		if err := checkChannelName(mc.Name); err != nil {
+			return nil, fmt.Errorf("mix %q: %w", mc.Name, err)
+		}
+		if _, ok := configs[mc.Name]; ok {
+			return nil, fmt.Errorf("mix %q is listed more than once", mc.Name)
+		}
+		if err := checkChannelMeta(mc.ChannelMeta); err != nil {
+			return nil, fmt.Errorf("mix %q: %w", mc.Name, err)
+		}
+		if len(mc.Sources) == 0 {
+			return nil, fmt.Errorf("mix %q has no sources", mc.Name)
+		}
+		seen := make(map[string]bool)
+		for _, src := range mc.Sources {
+			if err := checkChannelName(src.Channel); err != nil {
+				return nil, fmt.Errorf("mix %q source %q: %w", mc.Name, src.Channel, err)
+			}
+			if src.Channel == mc.Name || seen[src.Channel] {
+				return nil, fmt.Errorf("mix %q source %q is listed more than once", mc.Name, src.Channel)
+			}
+			if src.GainDB < minMixGain || src.GainDB > maxMixGain {
+				return nil, fmt.Errorf("mix %q source %q gain must be between %d and %d dB", mc.Name, src.Channel, minMixGain, maxMixGain)
+			}
+			if channels.ListenerAuthRequired(src.Channel) && !channels.ListenerAuthRequired(mc.Name) {
+				return nil, fmt.Errorf("mix %q source %q is private, the mix must be a reserved channel with a listener password", mc.Name, src.Channel)
+			}
+			seen[src.Channel] = true
+		}
+		configs[mc.Name] = mc
+	}
+	// mixes are made from publishers' audio only
+	for _, mc := range configs {
+		for _, src := range mc.Sources {
+			if _, ok := configs[src.Channel]; ok {
+				return nil, fmt.Errorf("mix %q source %q is itself a mix", mc.Name, src.Channel)
+			}
+		}
+	}
+	return configs, nil
+}
+
+// mixer publishes a mix channel while any of its sources has a publisher
+type mixer struct {
+	config *MixConfig
+	reg    *Registry
+	// codec is the mix channel's codec
+	codec  webrtc.RTPCodecCapability
+	enc    opusEncoder
+	inputs []*mixInput
+	logger *slog.Logger
+}
+
+// mixInput is the decoded audio of one source, waiting to be mixed
+type mixInput struct {
+	sync.Mutex
+	channel string
+	gain    float32
+	dec     opusDecoder
+	pcm     []float32
+	// primed is set once enough audio is buffered to start mixing it in
+	primed bool
+}
+
+func newMixer(reg *Registry, config *MixConfig, codec webrtc.RTPCodecCapability, bitrate int) (*mixer, error) {
+	enc, err := newOpusEncoder(bitrate)
+	if err != nil {
+		return nil, err
+	}
+	m := &mixer{
+		config: config,
+		reg:    reg,
+		codec:  codec,
+		enc:    enc,
+		logger: slog.With("mix", config.Name),
+	}
+	for _, src := range config.Sources {
+		dec, err := newOpusDecoder()
+		if err != nil {
+			return nil, err
+		}
+		m.inputs = append(m.inputs, &mixInput{
+			channel: src.Channel,
+			gain:    float32(math.Pow(10, src.GainDB/20)),
+			dec:     dec,
+			pcm:     make([]float32, 0, mixMaxBufferedSamples),
+		})
+	}
+	return m, nil
+}
+
+// run publishes the mix channel while any of its sources are live, and feeds it a frame of
+// mixed audio every mixFrameDuration
+func (m *mixer) run() {
+	id := "mix:" + m.config.Name
+	for _, in := range m.inputs {
+		go in.decode(m.reg.Tap(in.channel, id), m.logger)
+	}
+	channels := m.reg.WatchChannels(id)
+	ticker := time.NewTicker(mixFrameDuration)
+	defer ticker.Stop()
+
+	var p *Publisher
+	var quit chan struct{}
+	frame := make([]float32, mixFrameSamples*mixChannels)
+	buf := make([]byte, 1500)
+	pkt := &rtp.Packet{Header: rtp.Header{Version: 2, PayloadType: opusPayloadType}}
+	for {
+		select {
+		case listings := <-channels:
+			live := m.sourcesLive(listings)
+			if live && p == nil {
+				p = m.publish()
+				if p != nil {
+					quit = p.QuitChan
+				}
+			} else if !live && p != nil {
+				m.reg.RemovePublisherNow(m.config.Name, p.ID)
+				m.logger.Info("mix sources gone, mix stopped")
+				p, quit = nil, nil
+			}
+		case <-quit:
+			// kicked by an admin, publish again when the sources next change
+			m.logger.Info("mix disconnected by admin")
+			m.reg.RemovePublisherNow(m.config.Name, p.ID)
+			p, quit = nil, nil
+		case <-ticker.C:
+			clear(frame)
+			for _, in := range m.inputs {
+				in.mixInto(frame)
+			}
+			if p == nil {
+				continue
+			}
+			for i, s := range frame {
+				frame[i] = max(-1, min(1, s))
+			}
+			n, err := m.enc.EncodeFloat32(frame, buf)
+			if err != nil {
+				m.logger.Error("opus encode error", "err", err)
+				continue
+			}
+			pkt.Payload = buf[:n]
+			// the track writer rewrites sequence numbers and timestamps, so they need
+			// only be consecutive here
+			pkt.SequenceNumber++
+			pkt.Timestamp += mixFrameSamples
+			if err := p.WriteRTP(pkt); err != nil && !errors.Is(err, io.ErrClosedPipe) {
+				m.logger.Error("mix write error", "err", err)
+			}
+		}
+	}
+}
+
+// sourcesLive returns true if any of the mix's sources are in the channel list
+func (m *mixer) sourcesLive(listings []ChannelListing) bool {
+	for _, l := range listings {
+		for _, in := range m.inputs {
+			if l.Name == in.channel {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// publish adds the mix channel to the registry, returning nil on failure
+func (m *mixer) publish() *Publisher {
+	track, err := webrtc.NewTrackLocalStaticRTP(m.codec, "audio", "babelcast")
+	if err != nil {
+		m.logger.Error("mix track error", "err", err)
+		return nil
+	}
+	p, err := m.reg.AddPublisher(m.config.Name, track, "mixer", "", "", false, m.config.ChannelMeta)
+	if err != nil {
+		m.logger.Error("mix publish error", "err", err)
+		return nil
+	}
+	m.reg.SetICEState(m.config.Name, p.ID, webrtc.ICEConnectionStateConnected)
+	m.logger.Info("mix started")
+	return p
+}
+
+// decode decodes the source's packets into its buffer until the tap is closed. Late and
+// duplicate packets are dropped. Lost packets are recovered from the next packet's forward
+// error correction where possible, and otherwise concealed
+func (in *mixInput) decode(packets chan *rtp.Packet, logger *slog.Logger) {
+	pcm := make([]float32, maxOpusPacketSamples*mixChannels)
+	failing := false
+	var lastSeq uint16
+	started := false
+	// lastSamples is the duration of the last packet, which lost packets are assumed to match
+	lastSamples := mixFrameSamples
+	for pkt := range packets {
+		if started {
+			diff := int16(pkt.SequenceNumber - lastSeq)
+			if diff <= 0 && diff > -mixMaxLatePackets {
+				continue
+			}
+			if lost := int(diff) - 1; lost > 0 && lost <= mixMaxConcealedPackets && !failing {
+				lostPCM := pcm[: lastSamples*mixChannels : lastSamples*mixChannels]
+				for i := range lost {
+					var err error
+					if i == lost-1 {
+						err = in.dec.DecodeFECFloat32(pkt.Payload, lostPCM)
+					} else {
+						err = in.dec.DecodePLCFloat32(lostPCM)
+					}
+					if err != nil {
+						logger.Debug("mix source concealment error", "channel", in.channel, "err", err)
+						break
+					}
+					in.buffer(lostPCM)
+				}
+			}
+		}
+		lastSeq = pkt.SequenceNumber
+		started = true
+
+		n, err := in.dec.DecodeFloat32(pkt.Payload, pcm)
+		if err != nil {
+			// e.g. the source isn't Opus. Log once until it recovers
+			if !failing {
+				logger.Warn("mix source decode error", "channel", in.channel, "err", err)
+				failing = true
+			}
+			continue
+		}
+		failing = false
+		lastSamples = n
+		in.buffer(pcm[:n*mixChannels])
+	}
+}
+
+// buffer adds decoded audio to the source's buffer, dropping the oldest if it is full
+func (in *mixInput) buffer(pcm []float32) {
+	in.Lock()
+	defer in.Unlock()
+	in.pcm = append(in.pcm, pcm...)
+	if over := len(in.pcm) - mixMaxBufferedSamples; over > 0 {
+		in.pcm = in.pcm[:copy(in.pcm, in.pcm[over:])]
+	}
+}
+
+// mixInto adds a frame of the source's audio to frame, once enough has been buffered.
+// A source that runs dry is buffered again before it is mixed back in
+func (in *mixInput) mixInto(frame []float32) {
+	in.Lock()
+	defer in.Unlock()
+	if !in.primed {
+		if len(in.pcm) < mixJitterSamples {
+			return
+		}
+		in.primed = true
+	}
+	n := min(len(in.pcm), len(frame))
+	for i, s := range in.pcm[:n] {
+		frame[i] += s * in.gain
+	}
+	in.pcm = in.pcm[:copy(in.pcm, in.pcm[n:])]
+	if n < len(frame) {
+		in.primed = false
+	}
+}
+
+// StartMixers starts publishing the configured mix channels
+func StartMixers(reg *Registry, mc MediaConfig) error {
+	codec := mc.codecs()[0].RTPCodecCapability
+	for _, config := range mixConfigs {
+		m, err := newMixer(reg, config, codec, mc.OpusMaxAverageBitrate)
+		if err != nil {
+			return fmt.Errorf("mix %q: %w", config.Name, err)
+		}
+		go m.run()
+	}
+	return nil
+}
+
+// checkNotMix returns an error if the channel is a mix, which publishers can't take over
+func checkNotMix(channelName string) error {
+	if _, ok := mixConfigs[channelName]; ok {
+		return fmt.Errorf("channel %q is a mix of %s", channelName, mixConfigs[channelName].sourceNames())
+	}
+	return nil
+}
+
+func (mc *MixConfig) sourceNames() string {
+	names := make([]string, len(mc.Sources))
+	for i, src := range mc.Sources {
+		names[i] = src.Channel
+	}
+	return strings.Join(names, " and ")
+}
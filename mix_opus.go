@@ -0,0 +1,41 @@
+//go:build opus
+
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import "gopkg.in/hraban/opus.v2"
+
+func newOpusDecoder() (opusDecoder, error) {
+	dec, err := opus.NewDecoder(mixSampleRate, mixChannels)
+	if err != nil {
+		return nil, err
+	}
+	return dec, nil
+}
+
+// newOpusEncoder returns an encoder for mixes. A bitrate of 0 leaves it to libopus
+func newOpusEncoder(bitrate int) (opusEncoder, error) {
+	enc, err := opus.NewEncoder(mixSampleRate, mixChannels, opus.AppAudio)
+	if err != nil {
+		return nil, err
+	}
+	if bitrate > 0 {
+		if err := enc.SetBitrate(bitrate); err != nil {
+			return nil, err
+		}
+	}
+	return enc, nil
+}
@@ -0,0 +1,77 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"slices"
+	"testing"
+
+	"github.com/pion/rtp"
+)
+
+// testDecoder records the calls made to it, and decodes every packet to one frame
+type testDecoder struct {
+	calls []string
+}
+
+func (d *testDecoder) DecodeFloat32(data []byte, pcm []float32) (int, error) {
+	d.calls = append(d.calls, fmt.Sprintf("decode %d", data[0]))
+	return mixFrameSamples, nil
+}
+
+func (d *testDecoder) DecodeFECFloat32(data []byte, pcm []float32) error {
+	d.calls = append(d.calls, fmt.Sprintf("fec %d", data[0]))
+	return nil
+}
+
+func (d *testDecoder) DecodePLCFloat32(pcm []float32) error {
+	d.calls = append(d.calls, "plc")
+	return nil
+}
+
+func TestMixInputDecode(t *testing.T) {
+	tests := []struct {
+		name string
+		seqs []uint16
+		want []string
+	}{
+		{"in order", []uint16{1, 2, 3}, []string{"decode 1", "decode 2", "decode 3"}},
+		{"duplicate", []uint16{1, 2, 2, 3}, []string{"decode 1", "decode 2", "decode 3"}},
+		{"late", []uint16{1, 3, 2, 4}, []string{"decode 1", "fec 3", "decode 3", "decode 4"}},
+		{"gap", []uint16{1, 4}, []string{"decode 1", "plc", "fec 4", "decode 4"}},
+		{"wraparound", []uint16{65534, 65535, 1}, []string{"decode 254", "decode 255", "fec 1", "decode 1"}},
+		{"long gap", []uint16{1, 100}, []string{"decode 1", "decode 100"}},
+		{"restart", []uint16{1000, 2, 3}, []string{"decode 232", "decode 2", "decode 3"}},
+	}
+	for _, tt := range tests {
+		dec := &testDecoder{}
+		in := &mixInput{channel: "test", dec: dec}
+		packets := make(chan *rtp.Packet, len(tt.seqs))
+		for _, seq := range tt.seqs {
+			packets <- &rtp.Packet{Header: rtp.Header{SequenceNumber: seq}, Payload: []byte{byte(seq)}}
+		}
+		close(packets)
+		in.decode(packets, slog.Default())
+
+		if !slices.Equal(dec.calls, tt.want) {
+			t.Errorf("%s: decoder calls %q, want %q", tt.name, dec.calls, tt.want)
+		}
+		if want := (len(tt.want)) * mixFrameSamples * mixChannels; len(in.pcm) != min(want, mixMaxBufferedSamples) {
+			t.Errorf("%s: buffered %d samples, want %d", tt.name, len(in.pcm), want)
+		}
+	}
+}
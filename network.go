@@ -0,0 +1,227 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"strings"
+
+	"github.com/pion/ice/v4"
+	"github.com/pion/webrtc/v4"
+)
+
+// how many ICE-TCP packets are buffered per connection
+const iceTCPReadBufferSize = 8
+
+// webrtcAPI is shared by all peer connections, so that they share the same network settings
+var webrtcAPI = webrtc.NewAPI()
+
+// NetworkConfig controls which addresses and ports peer connections use for ICE
+type NetworkConfig struct {
+	// UDPPortMin and UDPPortMax limit the ephemeral UDP ports used by each peer connection
+	UDPPortMin uint16
+	UDPPortMax uint16
+	// UDPMuxPort, if set, is a single UDP port shared by all peer connections
+	UDPMuxPort int
+	// TCPMuxPort, if set, is a single TCP port shared by all peer connections for ICE-TCP
+	TCPMuxPort int
+	// PublicIPs are advertised in host candidates in place of the local addresses, for servers
+	// behind 1:1 NAT. Either a single IP for all local addresses, or a list of public/local pairs
+	PublicIPs []string
+	// Interfaces, if set, limits candidates to these network interfaces
+	Interfaces []string
+	// Networks, if set, limits candidates to addresses in these CIDR ranges
+	Networks []string
+}
+
+// NewWebRTCAPI returns an API for creating peer connections with the given network and media
+// settings. The returned closer releases any shared ports
+func NewWebRTCAPI(nc NetworkConfig, mc MediaConfig) (*webrtc.API, io.Closer, error) {
+	m, ir, err := newMediaEngine(mc)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	se := webrtc.SettingEngine{}
+	closers := multiCloser{}
+
+	if nc.UDPPortMin != 0 || nc.UDPPortMax != 0 {
+		if nc.UDPMuxPort != 0 {
+			return nil, nil, fmt.Errorf("UDP port range can't be used with a UDP mux port")
+		}
+		if err := se.SetEphemeralUDPPortRange(nc.UDPPortMin, nc.UDPPortMax); err != nil {
+			return nil, nil, fmt.Errorf("UDP port range: %w", err)
+		}
+	}
+
+	if len(nc.PublicIPs) > 0 {
+		if err := checkPublicIPs(nc.PublicIPs); err != nil {
+			return nil, nil, err
+		}
+		se.SetNAT1To1IPs(nc.PublicIPs, webrtc.ICECandidateTypeHost)
+	}
+
+	// the UDP mux gathers its own addresses, so needs the same filters
+	var muxOpts []ice.UDPMuxFromPortOption
+
+	if filter := nc.interfaceFilter(); filter != nil {
+		se.SetInterfaceFilter(filter)
+		muxOpts = append(muxOpts, ice.UDPMuxFromPortWithInterfaceFilter(filter))
+	}
+
+	ipFilter, err := nc.ipFilter()
+	if err != nil {
+		return nil, nil, err
+	}
+	if ipFilter != nil {
+		se.SetIPFilter(ipFilter)
+		muxOpts = append(muxOpts, ice.UDPMuxFromPortWithIPFilter(ipFilter))
+	}
+
+	if nc.UDPMuxPort != 0 {
+		udpMux, err := ice.NewMultiUDPMuxFromPort(nc.UDPMuxPort, muxOpts...)
+		if err != nil {
+			return nil, nil, fmt.Errorf("UDP mux: %w", err)
+		}
+		se.SetICEUDPMux(udpMux)
+		closers = append(closers, udpMux)
+	}
+
+	if nc.TCPMuxPort != 0 {
+		tcpListener, err := net.ListenTCP("tcp", &net.TCPAddr{Port: nc.TCPMuxPort})
+		if err != nil {
+			closers.Close()
+			return nil, nil, fmt.Errorf("TCP mux: %w", err)
+		}
+		tcpMux := webrtc.NewICETCPMux(nil, tcpListener, iceTCPReadBufferSize)
+		se.SetICETCPMux(tcpMux)
+		se.SetNetworkTypes([]webrtc.NetworkType{
+			webrtc.NetworkTypeUDP4, webrtc.NetworkTypeUDP6,
+			webrtc.NetworkTypeTCP4, webrtc.NetworkTypeTCP6,
+		})
+		closers = append(closers, tcpMux)
+	}
+
+	api := webrtc.NewAPI(webrtc.WithSettingEngine(se), webrtc.WithMediaEngine(m), webrtc.WithInterceptorRegistry(ir))
+	return api, closers, nil
+}
+
+// interfaceFilter returns a filter for the interfaces ICE may use, or nil for all of them
+func (nc NetworkConfig) interfaceFilter() func(string) bool {
+	if len(nc.Interfaces) == 0 {
+		return nil
+	}
+	interfaces := nc.Interfaces
+	return func(name string) bool {
+		return slices.Contains(interfaces, name)
+	}
+}
+
+// ipFilter returns a filter for the addresses ICE may use, or nil for all of them
+func (nc NetworkConfig) ipFilter() (func(net.IP) bool, error) {
+	if len(nc.Networks) == 0 {
+		return nil, nil
+	}
+	networks := make([]*net.IPNet, 0, len(nc.Networks))
+	for _, n := range nc.Networks {
+		_, ipNet, err := net.ParseCIDR(n)
+		if err != nil {
+			return nil, fmt.Errorf("ICE network: %w", err)
+		}
+		networks = append(networks, ipNet)
+	}
+	return func(ip net.IP) bool {
+		return slices.ContainsFunc(networks, func(n *net.IPNet) bool { return n.Contains(ip) })
+	}, nil
+}
+
+// localIPs returns the addresses of the interfaces that are up and not loopback, that ICE
+// may gather candidates from
+func (nc NetworkConfig) localIPs() ([]net.IP, error) {
+	interfaceFilter := nc.interfaceFilter()
+	ipFilter, err := nc.ipFilter()
+	if err != nil {
+		return nil, err
+	}
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	var ips []net.IP
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		if interfaceFilter != nil && !interfaceFilter(iface.Name) {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			ipNet, ok := a.(*net.IPNet)
+			if !ok || (ipFilter != nil && !ipFilter(ipNet.IP)) {
+				continue
+			}
+			ips = append(ips, ipNet.IP)
+		}
+	}
+	return ips, nil
+}
+
+// checkPublicIPs checks addresses are either all plain IPs, or all public/local pairs
+func checkPublicIPs(ips []string) error {
+	pairs := strings.Contains(ips[0], "/")
+	for _, ip := range ips {
+		public, local, isPair := strings.Cut(ip, "/")
+		if isPair != pairs {
+			return fmt.Errorf("public IPs must either all be plain IPs, or all public/local pairs")
+		}
+		if net.ParseIP(public) == nil || (isPair && net.ParseIP(local) == nil) {
+			return fmt.Errorf("invalid public IP %q", ip)
+		}
+	}
+	if !pairs && len(ips) > 1 {
+		return fmt.Errorf("more than one public IP needs the local IP each maps to e.g. 203.0.113.1/10.0.0.1")
+	}
+	return nil
+}
+
+// splitList splits a comma separated flag value, ignoring empty items
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+type multiCloser []io.Closer
+
+func (mc multiCloser) Close() error {
+	var firstErr error
+	for _, c := range mc {
+		if err := c.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
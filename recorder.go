@@ -0,0 +1,172 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4/pkg/media/oggwriter"
+)
+
+// number of packets buffered between the forwarding loop and the disk, about 10 seconds of Opus
+const recorderBufferSize = 500
+
+const recordingTimeFormat = "20060102T150405Z"
+
+// Recorder writes a publisher session's RTP stream to Ogg/Opus files. Packets are handed to
+// a separate goroutine so that a slow disk never holds up forwarding. If the buffer fills,
+// packets are dropped from the recording.
+type Recorder struct {
+	dir         string
+	rotate      time.Duration
+	channelName string
+	sessionID   string
+	logger      *slog.Logger
+
+	packets chan *rtp.Packet
+	dropped int
+	// done is closed once the recording is finished
+	done chan struct{}
+
+	ogg      *oggwriter.OggWriter
+	partName string
+	started  time.Time
+}
+
+// NewRecorder starts recording a publisher session into dir. A new file is started
+// every rotate interval, zero disables rotation
+func NewRecorder(dir string, rotate time.Duration, channelName string, sessionID string, logger *slog.Logger) *Recorder {
+	rec := &Recorder{
+		dir:         dir,
+		rotate:      rotate,
+		channelName: channelName,
+		sessionID:   sessionID,
+		logger:      logger.With("channel", channelName),
+		packets:     make(chan *rtp.Packet, recorderBufferSize),
+		done:        make(chan struct{}),
+	}
+	go rec.run()
+	return rec
+}
+
+// WriteRTP queues a packet for recording. It never blocks
+func (rec *Recorder) WriteRTP(pkt *rtp.Packet) {
+	select {
+	case rec.packets <- pkt.Clone():
+		if rec.dropped > 0 {
+			rec.logger.Warn("recorder caught up", "dropped_packets", rec.dropped)
+			rec.dropped = 0
+		}
+	default:
+		if rec.dropped == 0 {
+			rec.logger.Warn("recorder can't keep up, dropping packets")
+		}
+		rec.dropped++
+	}
+}
+
+// Close finishes the recording. It must not be called concurrently with WriteRTP
+func (rec *Recorder) Close() {
+	close(rec.packets)
+}
+
+// Done is closed once the recording has been written and its last file renamed
+func (rec *Recorder) Done() <-chan struct{} {
+	return rec.done
+}
+
+func (rec *Recorder) run() {
+	defer close(rec.done)
+	failed := false
+	for pkt := range rec.packets {
+		if failed {
+			continue
+		}
+		if rec.ogg != nil && rec.rotate > 0 && time.Since(rec.started) >= rec.rotate {
+			rec.closeFile()
+		}
+		if rec.ogg == nil {
+			if err := rec.openFile(); err != nil {
+				rec.logger.Error("recorder open error, recording stopped", "err", err)
+				failed = true
+				continue
+			}
+		}
+		if err := rec.ogg.WriteRTP(pkt); err != nil {
+			rec.logger.Error("recorder write error", "err", err)
+		}
+	}
+	rec.closeFile()
+}
+
+// fileBase returns the recording's file name, without extension
+func (rec *Recorder) fileBase(times ...time.Time) string {
+	parts := []string{strings.ReplaceAll(rec.channelName, " ", "_")}
+	for _, t := range times {
+		parts = append(parts, t.UTC().Format(recordingTimeFormat))
+	}
+	parts = append(parts, rec.sessionID)
+	return filepath.Join(rec.dir, strings.Join(parts, "_"))
+}
+
+// openFile starts a new file. While it is being written, it has a .part suffix
+// and no end time in its name
+func (rec *Recorder) openFile() error {
+	rec.started = time.Now()
+	rec.partName = rec.fileBase(rec.started) + ".ogg.part"
+	ogg, err := oggwriter.New(rec.partName, 48000, 2)
+	if err != nil {
+		return err
+	}
+	rec.ogg = ogg
+	rec.logger.Info("recording started", "file", rec.partName)
+	return nil
+}
+
+// closeFile finishes the current file and renames it to include the end time
+func (rec *Recorder) closeFile() {
+	if rec.ogg == nil {
+		return
+	}
+	if err := rec.ogg.Close(); err != nil {
+		rec.logger.Error("recorder close error", "err", err)
+	}
+	rec.ogg = nil
+	name := rec.fileBase(rec.started, time.Now()) + ".ogg"
+	if err := os.Rename(rec.partName, name); err != nil {
+		rec.logger.Error("recorder rename error", "err", err)
+		return
+	}
+	rec.logger.Info("recording finished", "file", name)
+}
+
+// checkRecordDir makes sure the recording directory exists and is writable
+func checkRecordDir(dir string) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, ".babelcast")
+	if err != nil {
+		return fmt.Errorf("recording directory not writable: %w", err)
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
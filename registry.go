@@ -1,71 +1,354 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log/slog"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/google/uuid"
+	"github.com/pion/rtp"
 	"github.com/pion/webrtc/v4"
 )
 
+// subscriberCountInterval is the most often a channel's publishers and subscribers are told
+// its subscriber count, so that a flood of joins doesn't flood them with messages
+const subscriberCountInterval = time.Second
+
 // keep track of which channels are being used
-// only permit one publisher per channel
+// only permit one active publisher per channel, plus an optional standby
 type Registry struct {
 	sync.Mutex
 	channels map[string]*Channel
+	// watchers receive the list of channels each time it changes
+	watchers map[string]chan []ChannelListing
+	// locked channels accept no new publishers
+	locked map[string]bool
+	// taps receive copies of channels' packets, keyed by channel name
+	taps map[string]*packetTaps
+	// recorders are the publisher recordings in progress
+	recorders map[*Recorder]struct{}
+
+	// PublisherGrace is how long a channel is kept open after its publisher disconnects,
+	// allowing the publisher to reconnect without subscribers being dropped. Zero disables it.
+	PublisherGrace time.Duration
+	// SilenceTimeout is how long a channel must be silent before it is reported, and
+	// SilenceLevel is the audio level in dBov below which it counts as silent
+	SilenceTimeout time.Duration
+	SilenceLevel   float64
 }
 
 type Channel struct {
 	LocalTrack *webrtc.TrackLocalStaticRTP
+	// Codec is the codec negotiated with the channel's first publisher. Later publishers
+	// and all subscribers must use the same codec
+	Codec  webrtc.RTPCodecCapability
+	writer *trackWriter
+	// Meta is set by the publisher that opened the channel
+	Meta ChannelMeta
 
 	Publisher   *Publisher
+	Standby     *Publisher
 	Subscribers map[string]*Subscriber
+
+	// countTimer is set while a subscriber count update is pending
+	countTimer *time.Timer
 }
 
 type Publisher struct {
 	ID string
+	// ResumeToken lets a reconnecting publisher take over the channel during the grace period
+	ResumeToken string
+	// Addr is the publisher's client address for display, including port and any X-Forwarded-For
+	Addr        string
+	ConnectedAt time.Time
+	// ICEState is the publisher's latest ICE connection state
+	ICEState string
+	// ActiveChan receives the publisher's latest state each time it changes between
+	// active (on air) and standby
+	ActiveChan chan bool
+	// AudioLevelExtID is the ID of the publisher's RTP audio level header extension, or 0
+	// if it doesn't send one. It is set before the publisher's first packet is written
+	AudioLevelExtID uint8
+	// QuitChan is closed when the publisher is disconnected by an admin, or replaced by a
+	// resumed session
+	QuitChan chan struct{}
+	// CountChan receives the channel's subscriber count when the publisher joins and
+	// each time it changes. Only the latest count is kept
+	CountChan chan int
+	// TalkbackChan receives the publisher's talkback track when an operator starts talking
+	// to them, and nil when they stop. Only the latest is kept
+	TalkbackChan chan *webrtc.TrackLocalStaticRTP
+	// acceptsTalkback is set if the publisher can be sent talkback
+	acceptsTalkback bool
+	// talkbackID is the operator talking to the publisher, if any
+	talkbackID string
+	// talkback writes operators' audio to the publisher, once one has talked to them
+	talkback *talkbackWriter
+	// writer feeds the publisher's RTP packets to the channel's local track
+	writer *trackWriter
+
+	// graceTimer is set while the publisher is disconnected and the channel is being held open
+	graceTimer *time.Timer
+}
+
+// WriteRTP forwards an RTP packet from the publisher to the channel's subscribers.
+// Packets from a standby publisher are discarded
+func (p *Publisher) WriteRTP(pkt *rtp.Packet) error {
+	return p.writer.writeRTP(p.ID, pkt, p.AudioLevelExtID)
 }
+
 type Subscriber struct {
-	ID       string
+	ID string
+	// Addr is the subscriber's client address for display
+	Addr        string
+	ConnectedAt time.Time
+	// ICEState is the subscriber's latest ICE connection state
+	ICEState string
 	QuitChan chan struct{}
+	// CountChan receives the channel's subscriber count each time it changes. Only the
+	// latest count is kept
+	CountChan chan int
+}
+
+// sendLatest sends v on ch, which must have a buffer of one, replacing any value not yet
+// received. Callers hold the registry lock, so there is only ever one sender and it never blocks
+func sendLatest[T any](ch chan T, v T) {
+	select {
+	case <-ch:
+	default:
+	}
+	ch <- v
 }
 
 func NewRegistry() *Registry {
 	r := &Registry{}
 	r.channels = make(map[string]*Channel)
+	r.watchers = make(map[string]chan []ChannelListing)
+	r.locked = make(map[string]bool)
+	r.taps = make(map[string]*packetTaps)
+	r.recorders = make(map[*Recorder]struct{})
 	return r
 }
 
-func (r *Registry) AddPublisher(channelName string, localTrack *webrtc.TrackLocalStaticRTP) error {
+// AddRecorder keeps track of a recording until it has finished, so Shutdown can wait for it
+func (r *Registry) AddRecorder(rec *Recorder) {
+	r.Lock()
+	r.recorders[rec] = struct{}{}
+	r.Unlock()
+	go func() {
+		<-rec.Done()
+		r.Lock()
+		delete(r.recorders, rec)
+		r.Unlock()
+	}()
+}
+
+// Shutdown disconnects every publisher and subscriber, then waits for the publishers'
+// recordings to be finished or for ctx to be done
+func (r *Registry) Shutdown(ctx context.Context) error {
+	r.Lock()
+	for name, channel := range r.channels {
+		for _, p := range []*Publisher{channel.Publisher, channel.Standby} {
+			if p == nil {
+				continue
+			}
+			if p.graceTimer != nil {
+				p.graceTimer.Stop()
+			}
+			close(p.QuitChan)
+		}
+		channel.Standby = nil
+		channel.removePublisher(name)
+	}
+	recorders := make([]*Recorder, 0, len(r.recorders))
+	for rec := range r.recorders {
+		recorders = append(recorders, rec)
+	}
+	r.notifyWatchers()
+	r.Unlock()
+
+	for _, rec := range recorders {
+		select {
+		case <-rec.Done():
+		case <-ctx.Done():
+			return fmt.Errorf("recordings not finished: %w", ctx.Err())
+		}
+	}
+	return nil
+}
+
+// AddPublisher adds a publisher to the channel. If the channel's previous publisher
+// disconnected within the grace period and the new publisher holds its resume token, the
+// new publisher takes over the channel's existing local track.
+// A publisher holding the resume token also takes over from an active publisher, whose
+// session is assumed to be stale after a network drop, and which is told to quit.
+// A standby publisher is added alongside the channel's active publisher and only goes on
+// air when the active publisher hands over or drops out. Only a publisher that opens the
+// channel sets its metadata, resuming and standby publishers keep the existing metadata
+//
+// newToken is the resume token issued to a publisher that isn't resuming, or a new one is
+// generated if empty. WHIP publishers are told theirs before they are added
+func (r *Registry) AddPublisher(channelName string, localTrack *webrtc.TrackLocalStaticRTP, addr string, resumeToken string, newToken string, standby bool, meta ChannelMeta) (*Publisher, error) {
 	r.Lock()
 	defer r.Unlock()
+	if r.locked[channelName] {
+		return nil, fmt.Errorf("channel %q is locked", channelName)
+	}
 	var channel *Channel
 	var ok bool
 	p := Publisher{}
 	p.ID = uuid.NewString()
+	p.Addr = addr
+	p.ConnectedAt = time.Now()
+	p.ActiveChan = make(chan bool, 1)
+	p.QuitChan = make(chan struct{})
+	p.CountChan = make(chan int, 1)
+	p.TalkbackChan = make(chan *webrtc.TrackLocalStaticRTP, 1)
+	if newToken == "" {
+		newToken = uuid.NewString()
+	}
 	if channel, ok = r.channels[channelName]; ok {
+		if err := channel.checkAvailable(channelName, resumeToken, standby); err != nil {
+			return nil, err
+		}
+		// a resuming or standby publisher joins a channel that may already have subscribers
+		sendLatest(p.CountChan, len(channel.Subscribers))
 		if channel.Publisher != nil {
-			return fmt.Errorf("channel %q is already in use", channelName)
+			if !strings.EqualFold(localTrack.Codec().MimeType, channel.Codec.MimeType) {
+				return nil, fmt.Errorf("codec %s doesn't match channel %q codec %s", localTrack.Codec().MimeType, channelName, channel.Codec.MimeType)
+			}
+			p.writer = channel.writer
+			old := channel.Publisher
+			if old.graceTimer == nil && !old.resumableBy(resumeToken, standby) {
+				p.ResumeToken = newToken
+				channel.Standby = &p
+				sendLatest(p.ActiveChan, false)
+				slog.Info("standby publisher added", "channel", channelName)
+				return &p, nil
+			}
+			if old.graceTimer != nil {
+				old.graceTimer.Stop()
+			} else {
+				// the old session hasn't noticed it's gone yet, tell it to quit
+				close(old.QuitChan)
+			}
+			if standby {
+				p.ResumeToken = newToken
+				slog.Info("standby publisher took over from disconnected publisher", "channel", channelName)
+			} else {
+				p.ResumeToken = old.ResumeToken
+				slog.Info("publisher resumed", "channel", channelName)
+			}
+			channel.setPublisher(&p)
+			return &p, nil
 		}
+		p.ResumeToken = newToken
+		p.writer = newTrackWriter(localTrack, channelName, r.SilenceLevel, r.channelTaps(channelName))
 		channel.LocalTrack = localTrack
-		channel.Publisher = &p
+		channel.Codec = localTrack.Codec()
+		channel.writer = p.writer
+		channel.Meta = meta
+		channel.setPublisher(&p)
 	} else {
+		sendLatest(p.CountChan, 0)
+		p.ResumeToken = newToken
+		p.writer = newTrackWriter(localTrack, channelName, r.SilenceLevel, r.channelTaps(channelName))
 		channel = &Channel{
 			LocalTrack:  localTrack,
-			Publisher:   &p,
+			Codec:       localTrack.Codec(),
+			writer:      p.writer,
+			Meta:        meta,
 			Subscribers: make(map[string]*Subscriber),
 		}
+		channel.setPublisher(&p)
 		r.channels[channelName] = channel
 	}
 	slog.Info("publisher added", "channel", channelName)
+	r.notifyWatchers()
+	return &p, nil
+}
+
+// CheckPublisherAvailable returns an error if a publisher with the given resume token would
+// not be able to publish to the channel
+func (r *Registry) CheckPublisherAvailable(channelName string, resumeToken string, standby bool) error {
+	r.Lock()
+	defer r.Unlock()
+	if r.locked[channelName] {
+		return fmt.Errorf("channel %q is locked", channelName)
+	}
+	if channel, ok := r.channels[channelName]; ok {
+		return channel.checkAvailable(channelName, resumeToken, standby)
+	}
 	return nil
 }
 
-func (r *Registry) NewSubscriber() *Subscriber {
+// checkAvailable returns nil if the channel has no publisher, if its publisher holds the
+// given resume token, or if a standby is requested and the channel doesn't have one yet
+func (channel *Channel) checkAvailable(channelName string, resumeToken string, standby bool) error {
+	p := channel.Publisher
+	if p == nil {
+		return nil
+	}
+	if standby {
+		if channel.Standby == nil {
+			return nil
+		}
+		return fmt.Errorf("channel %q already has a standby publisher", channelName)
+	}
+	if p.resumableBy(resumeToken, standby) {
+		return nil
+	}
+	return fmt.Errorf("channel %q is already in use", channelName)
+}
+
+// resumableBy returns true if a (non-standby) publisher holding the resume token may take over from p
+func (p *Publisher) resumableBy(resumeToken string, standby bool) bool {
+	return !standby && resumeToken != "" && resumeToken == p.ResumeToken
+}
+
+// setPublisher puts the publisher on air
+func (channel *Channel) setPublisher(p *Publisher) {
+	channel.Publisher = p
+	channel.writer.setSource(p.ID)
+	sendLatest(p.ActiveChan, true)
+}
+
+// HandOver switches the channel's active publisher with its standby. id must be the
+// active publisher, and the standby's ICE must be connected. The previous active publisher
+// becomes the standby
+func (r *Registry) HandOver(channelName string, id string) error {
+	r.Lock()
+	defer r.Unlock()
+	channel, ok := r.channels[channelName]
+	if !ok || channel.Publisher == nil || channel.Publisher.ID != id {
+		return fmt.Errorf("not the active publisher of channel %q", channelName)
+	}
+	if channel.Standby == nil {
+		return fmt.Errorf("channel %q has no standby publisher", channelName)
+	}
+	if s := channel.Standby.ICEState; s != webrtc.ICEConnectionStateConnected.String() && s != webrtc.ICEConnectionStateCompleted.String() {
+		return fmt.Errorf("channel %q standby publisher is not connected", channelName)
+	}
+	old := channel.Publisher
+	moveTalkback(old, channel.Standby)
+	channel.setPublisher(channel.Standby)
+	channel.Standby = old
+	sendLatest(old.ActiveChan, false)
+	slog.Info("publisher handed over to standby", "channel", channelName)
+	return nil
+}
+
+func (r *Registry) NewSubscriber(addr string) *Subscriber {
 	s := &Subscriber{}
 	s.QuitChan = make(chan struct{})
+	s.CountChan = make(chan int, 1)
 	s.ID = uuid.NewString()
+	s.Addr = addr
+	s.ConnectedAt = time.Now()
 	return s
 }
 
@@ -77,22 +360,78 @@ func (r *Registry) AddSubscriber(channelName string, s *Subscriber) error {
 	if channel, ok = r.channels[channelName]; ok && channel.Publisher != nil {
 		channel.Subscribers[s.ID] = s
 		slog.Info("subscriber added", "channel", channelName, "subscriber_count", len(channel.Subscribers))
+		r.subscribersChanged(channel)
 	} else {
 		return fmt.Errorf("channel %q not ready", channelName)
 	}
 	return nil
 }
 
-func (r *Registry) RemovePublisher(channelName string) {
+// RemovePublisher removes the publisher with the given ID from the channel. It does nothing
+// if the channel is held by a different publisher. If the channel has a standby, it goes on air.
+// Otherwise, if a grace period is configured, the channel and its subscribers are kept until it expires
+func (r *Registry) RemovePublisher(channelName string, id string) {
+	r.removePublisherAfter(channelName, id, r.PublisherGrace)
+}
+
+// RemovePublisherNow is RemovePublisher without the grace period, for publishers that won't
+// reconnect such as a mix whose sources are gone
+func (r *Registry) RemovePublisherNow(channelName string, id string) {
+	r.removePublisherAfter(channelName, id, 0)
+}
+
+func (r *Registry) removePublisherAfter(channelName string, id string, grace time.Duration) {
 	r.Lock()
 	defer r.Unlock()
-	if channel, ok := r.channels[channelName]; ok {
-		channel.Publisher = nil
-		// tell all subscribers to quit
-		for _, s := range channel.Subscribers {
-			close(s.QuitChan)
+	channel, ok := r.channels[channelName]
+	if !ok {
+		return
+	}
+	if channel.Standby != nil && channel.Standby.ID == id {
+		channel.Standby = nil
+		slog.Info("standby publisher removed", "channel", channelName)
+		return
+	}
+	if channel.Publisher != nil && channel.Publisher.ID == id {
+		if channel.Standby != nil {
+			moveTalkback(channel.Publisher, channel.Standby)
+			channel.setPublisher(channel.Standby)
+			channel.Standby = nil
+			slog.Info("publisher removed, standby publisher on air", "channel", channelName)
+			return
+		}
+		if grace > 0 {
+			channel.Publisher.graceTimer = time.AfterFunc(grace, func() {
+				r.expirePublisher(channelName, id)
+			})
+			slog.Info("publisher disconnected, holding channel open", "channel", channelName, "grace", grace)
+			return
 		}
+		channel.removePublisher(channelName)
 		slog.Info("publisher removed", "channel", channelName)
+		r.notifyWatchers()
+	}
+}
+
+// expirePublisher removes a disconnected publisher once the grace period is over,
+// unless it has been resumed in the meantime
+func (r *Registry) expirePublisher(channelName string, id string) {
+	r.Lock()
+	defer r.Unlock()
+	if channel, ok := r.channels[channelName]; ok && channel.Publisher != nil && channel.Publisher.ID == id {
+		channel.removePublisher(channelName)
+		slog.Info("publisher grace period expired, publisher removed", "channel", channelName)
+		r.notifyWatchers()
+	}
+}
+
+func (channel *Channel) removePublisher(channelName string) {
+	channel.Publisher = nil
+	deleteChannelMetrics(channelName)
+	// tell all subscribers to quit
+	for id, s := range channel.Subscribers {
+		close(s.QuitChan)
+		delete(channel.Subscribers, id)
 	}
 }
 
@@ -102,21 +441,156 @@ func (r *Registry) RemoveSubscriber(channelName string, id string) {
 	if channel, ok := r.channels[channelName]; ok {
 		delete(channel.Subscribers, id)
 		slog.Info("subscriber removed", "channel", channelName, "subscriber_count", len(channel.Subscribers))
+		r.subscribersChanged(channel)
 	}
 }
 
-func (r *Registry) GetChannels() []string {
+// MoveSubscriber moves a subscriber to another channel, which must have a publisher
+func (r *Registry) MoveSubscriber(from string, to string, id string) error {
 	r.Lock()
 	defer r.Unlock()
+	dest, ok := r.channels[to]
+	if !ok || dest.Publisher == nil {
+		return fmt.Errorf("channel %q not ready", to)
+	}
+	src, ok := r.channels[from]
+	if !ok {
+		return fmt.Errorf("channel %q not found", from)
+	}
+	s, ok := src.Subscribers[id]
+	if !ok {
+		return fmt.Errorf("not subscribed to channel %q", from)
+	}
+	delete(src.Subscribers, id)
+	dest.Subscribers[id] = s
+	slog.Info("subscriber moved", "from", from, "to", to, "subscriber_count", len(dest.Subscribers))
+	r.subscribersChanged(src)
+	r.subscribersChanged(dest)
+	return nil
+}
+
+// subscribersChanged sends the channel's subscriber count to its publishers and subscribers,
+// once subscriberCountInterval has passed since the first change. Further changes in the
+// meantime are included in the same update. r must be locked
+func (r *Registry) subscribersChanged(channel *Channel) {
+	if channel.countTimer != nil {
+		return
+	}
+	channel.countTimer = time.AfterFunc(subscriberCountInterval, func() {
+		r.Lock()
+		defer r.Unlock()
+		channel.countTimer = nil
+		count := len(channel.Subscribers)
+		for _, p := range []*Publisher{channel.Publisher, channel.Standby} {
+			if p != nil {
+				sendLatest(p.CountChan, count)
+			}
+		}
+		for _, s := range channel.Subscribers {
+			sendLatest(s.CountChan, count)
+		}
+	})
+}
+
+// GetChannels returns the channels that have a publisher, in the order they should be listed
+func (r *Registry) GetChannels() []ChannelListing {
+	r.Lock()
+	defer r.Unlock()
+	return r.channelListings()
+}
+
+// channelListings returns the channels that have a publisher, sorted by sortChannelListings.
+// r must be locked
+func (r *Registry) channelListings() []ChannelListing {
+	listings := make([]ChannelListing, 0)
+	for name, c := range r.channels {
+		if c.Publisher != nil {
+			listings = append(listings, ChannelListing{Name: name, ChannelMeta: c.Meta})
+		}
+	}
+	sortChannelListings(listings)
+	return listings
+}
+
+// channelNames returns the sorted names of channels that have a publisher. r must be locked
+func (r *Registry) channelNames() []string {
 	channels := make([]string, 0)
 	for name, c := range r.channels {
 		if c.Publisher != nil {
 			channels = append(channels, name)
 		}
 	}
+	sort.Strings(channels)
 	return channels
 }
 
+// SubscriberCounts returns the number of subscribers on each channel that has a publisher
+func (r *Registry) SubscriberCounts() map[string]int {
+	r.Lock()
+	defer r.Unlock()
+	counts := make(map[string]int)
+	for name, c := range r.channels {
+		if c.Publisher != nil {
+			counts[name] = len(c.Subscribers)
+		}
+	}
+	return counts
+}
+
+// WatchChannels returns a channel that receives the current list of channels, and
+// then the new list each time a channel is added or removed. Only the latest list is
+// kept, so a slow watcher never holds up the registry
+func (r *Registry) WatchChannels(id string) chan []ChannelListing {
+	r.Lock()
+	defer r.Unlock()
+	ch := make(chan []ChannelListing, 1)
+	ch <- r.channelListings()
+	r.watchers[id] = ch
+	return ch
+}
+
+func (r *Registry) UnwatchChannels(id string) {
+	r.Lock()
+	defer r.Unlock()
+	delete(r.watchers, id)
+}
+
+// notifyWatchers sends the list of channels to all watchers. r must be locked
+func (r *Registry) notifyWatchers() {
+	channels := r.channelListings()
+	for _, ch := range r.watchers {
+		sendLatest(ch, channels)
+	}
+}
+
+// channelTaps returns the channel's taps, creating them if needed. r must be locked
+func (r *Registry) channelTaps(channelName string) *packetTaps {
+	taps, ok := r.taps[channelName]
+	if !ok {
+		taps = newPacketTaps()
+		r.taps[channelName] = taps
+	}
+	return taps
+}
+
+// Tap returns a channel that receives a copy of every packet forwarded to the channel's
+// subscribers, from whichever publisher is on air, until Untap is called. The channel
+// doesn't need to have a publisher yet. Packets are dropped if the tap falls behind
+func (r *Registry) Tap(channelName string, id string) chan *rtp.Packet {
+	r.Lock()
+	defer r.Unlock()
+	return r.channelTaps(channelName).add(id)
+}
+
+// Untap removes the tap and closes its channel
+func (r *Registry) Untap(channelName string, id string) {
+	r.Lock()
+	defer r.Unlock()
+	if taps, ok := r.taps[channelName]; ok {
+		taps.remove(id)
+	}
+}
+
 func (r *Registry) GetChannel(channelName string) *Channel {
 	r.Lock()
 	defer r.Unlock()
@@ -0,0 +1,110 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+
+	"github.com/pion/webrtc/v4"
+)
+
+func newTrack(t *testing.T) *webrtc.TrackLocalStaticRTP {
+	t.Helper()
+	track, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2}, "audio", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return track
+}
+
+func TestAddPublisherResumeActive(t *testing.T) {
+	r := NewRegistry()
+	old, err := r.AddPublisher("English", newTrack(t), "", "", "", false, ChannelMeta{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a different token is refused while the publisher is active
+	if _, err := r.AddPublisher("English", newTrack(t), "", "wrong", "", false, ChannelMeta{}); err == nil {
+		t.Fatal("expected an error for a mismatched resume token")
+	}
+
+	// the resume token takes over from the stale session, e.g. after a network change
+	p, err := r.AddPublisher("English", newTrack(t), "", old.ResumeToken, "", false, ChannelMeta{})
+	if err != nil {
+		t.Fatalf("resume with token: %s", err)
+	}
+	select {
+	case <-old.QuitChan:
+	default:
+		t.Error("stale publisher was not told to quit")
+	}
+	if p.ResumeToken != old.ResumeToken {
+		t.Errorf("resume token = %q, want %q", p.ResumeToken, old.ResumeToken)
+	}
+	channel := r.channels["English"]
+	if channel.Publisher != p || channel.Standby != nil {
+		t.Error("resumed publisher is not the channel's active publisher")
+	}
+
+	// the stale session's cleanup must not remove the resumed publisher
+	r.RemovePublisherNow("English", old.ID)
+	if channel.Publisher != p {
+		t.Error("removing the stale publisher removed the resumed one")
+	}
+}
+
+func TestHandOverMovesTalkback(t *testing.T) {
+	r := NewRegistry()
+	active, err := r.AddPublisher("English", newTrack(t), "", "", "", false, ChannelMeta{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	standby, err := r.AddPublisher("English", newTrack(t), "", "", "", true, ChannelMeta{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.AcceptTalkback("English", active.ID)
+	r.AcceptTalkback("English", standby.ID)
+	r.SetICEState("English", standby.ID, webrtc.ICEConnectionStateConnected)
+
+	tw, err := r.StartTalkback("English", "operator", newTrack(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-active.TalkbackChan
+
+	if err := r.HandOver("English", active.ID); err != nil {
+		t.Fatal(err)
+	}
+	if standby.talkbackID != "operator" || standby.talkback != tw {
+		t.Error("talkback did not move to the new active publisher")
+	}
+	if active.talkbackID != "" {
+		t.Error("talkback still set on the publisher that handed over")
+	}
+	if track := <-standby.TalkbackChan; track != tw.track {
+		t.Error("new active publisher was not sent the talkback track")
+	}
+	if track := <-active.TalkbackChan; track != nil {
+		t.Error("publisher that handed over was not told talkback ended")
+	}
+
+	// the operator ending talkback reaches the publisher they were moved to
+	r.EndTalkback("English", "operator")
+	if track := <-standby.TalkbackChan; track != nil {
+		t.Error("talkback did not end")
+	}
+}
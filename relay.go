@@ -0,0 +1,116 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// relay is a publisher listening to another channel, the source they interpret from
+type relay struct {
+	channelName string
+	subscriber  *Subscriber
+	stop        chan struct{}
+}
+
+// listenSource lets a publisher hear another channel on their own connection while they publish,
+// replacing any channel they were listening to. An empty channel name stops listening
+func (c *Conn) listenSource(cmd CmdConnect) error {
+	if c.publisher == nil {
+		return fmt.Errorf("not a publisher")
+	}
+	sender := c.peer.sourceSender
+	if sender == nil {
+		return fmt.Errorf("this connection can't receive audio, it must offer to send and receive Opus")
+	}
+	if cmd.Channel == "" {
+		c.stopSource()
+		return nil
+	}
+	if err := checkChannelName(cmd.Channel); err != nil {
+		return err
+	}
+	if cmd.Channel == c.channelName {
+		return fmt.Errorf("can't listen to your own channel")
+	}
+	if err := channelConfigs.CheckListener(cmd.Channel, cmd.Password, cmd.Token); err != nil {
+		return err
+	}
+	channel := reg.GetChannel(cmd.Channel)
+	if channel == nil {
+		return fmt.Errorf("channel %q not found", cmd.Channel)
+	}
+	if !strings.EqualFold(channel.Codec.MimeType, c.peer.sourcePlaceholder.Codec().MimeType) {
+		return fmt.Errorf("channel %q uses %s, only Opus channels can be listened to", cmd.Channel, channel.Codec.MimeType)
+	}
+
+	c.stopSource()
+	s := reg.NewSubscriber(c.addr)
+	if err := reg.AddSubscriber(cmd.Channel, s); err != nil {
+		return err
+	}
+	if err := sender.ReplaceTrack(channel.LocalTrack); err != nil {
+		reg.RemoveSubscriber(cmd.Channel, s.ID)
+		return err
+	}
+	reg.SetICEState(cmd.Channel, s.ID, c.peer.pc.ICEConnectionState())
+	rl := &relay{channelName: cmd.Channel, subscriber: s, stop: make(chan struct{})}
+	c.Lock()
+	c.relay = rl
+	c.Unlock()
+	c.logger.Info("publisher listening to source", "channel", c.channelName, "source", cmd.Channel)
+
+	go func() {
+		select {
+		case <-s.QuitChan:
+			// the source channel closed or an admin kicked us from it. The publisher stays on air
+			c.Lock()
+			current := c.relay == rl
+			if current {
+				c.relay = nil
+				// never nil, as a failed replace would rebind the old track
+				sender.ReplaceTrack(c.peer.sourcePlaceholder)
+			}
+			c.Unlock()
+			if current {
+				j, _ := json.Marshal(cmd.Channel)
+				c.writeMsg(wsMsg{Key: "source_closed", Value: j})
+			}
+		case <-rl.stop:
+		case <-c.quitchan:
+		}
+	}()
+
+	return nil
+}
+
+// stopSource stops the publisher listening to their source channel, if they are
+func (c *Conn) stopSource() {
+	c.Lock()
+	rl := c.relay
+	c.relay = nil
+	c.Unlock()
+	if rl == nil {
+		return
+	}
+	close(rl.stop)
+	reg.RemoveSubscriber(rl.channelName, rl.subscriber.ID)
+	if err := c.peer.sourceSender.ReplaceTrack(c.peer.sourcePlaceholder); err != nil {
+		c.logger.Error("source track replace error", "err", err)
+	}
+	c.logger.Info("publisher stopped listening to source", "channel", c.channelName, "source", rl.channelName)
+}
@@ -0,0 +1,267 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/hmac"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/google/uuid"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+// talkback lets an operator, such as a sound technician, speak privately to one channel's
+// publisher. The operator's audio is added to the publisher's connection as an extra track,
+// and never reaches the channel's subscribers
+
+// talkbackWriter writes operators' RTP packets to a publisher's talkback track. The track is
+// kept for the life of the publisher, so successive operators form one continuous stream
+type talkbackWriter struct {
+	sync.Mutex
+	track *webrtc.TrackLocalStaticRTP
+	// active is the operator whose packets are written, if any
+	active string
+	sourceJoiner
+}
+
+// setSource sets the operator whose packets are written, or none if empty
+func (tw *talkbackWriter) setSource(source string) {
+	tw.Lock()
+	defer tw.Unlock()
+	tw.active = source
+}
+
+// writeRTP writes a packet from the given operator to the track, unless another operator is active
+func (tw *talkbackWriter) writeRTP(source string, pkt *rtp.Packet) error {
+	tw.Lock()
+	if source != tw.active {
+		tw.Unlock()
+		return nil
+	}
+	tw.join(source, pkt, tw.track.Codec().ClockRate)
+	tw.Unlock()
+	return tw.track.WriteRTP(pkt)
+}
+
+// AcceptTalkback marks the publisher as able to receive talkback, which needs a websocket to
+// renegotiate over
+func (r *Registry) AcceptTalkback(channelName string, id string) {
+	r.Lock()
+	defer r.Unlock()
+	channel, ok := r.channels[channelName]
+	if !ok {
+		return
+	}
+	for _, p := range []*Publisher{channel.Publisher, channel.Standby} {
+		if p != nil && p.ID == id {
+			p.acceptsTalkback = true
+		}
+	}
+}
+
+// StartTalkback lets the operator talk to the channel's active publisher, returning the
+// writer for their audio. The first operator's track becomes the publisher's talkback track,
+// later operators must use the same codec
+func (r *Registry) StartTalkback(channelName string, operatorID string, track *webrtc.TrackLocalStaticRTP) (*talkbackWriter, error) {
+	r.Lock()
+	defer r.Unlock()
+	channel, ok := r.channels[channelName]
+	if !ok || channel.Publisher == nil {
+		return nil, fmt.Errorf("channel %q not found", channelName)
+	}
+	p := channel.Publisher
+	if !p.acceptsTalkback {
+		return nil, fmt.Errorf("the publisher of channel %q can't receive talkback", channelName)
+	}
+	if p.talkbackID != "" && p.talkbackID != operatorID {
+		return nil, fmt.Errorf("someone is already talking to the publisher of channel %q", channelName)
+	}
+	if p.talkback == nil {
+		p.talkback = &talkbackWriter{track: track}
+	} else if !strings.EqualFold(track.Codec().MimeType, p.talkback.track.Codec().MimeType) {
+		return nil, fmt.Errorf("talkback codec %s doesn't match the publisher's talkback codec %s", track.Codec().MimeType, p.talkback.track.Codec().MimeType)
+	}
+	p.talkbackID = operatorID
+	p.talkback.setSource(operatorID)
+	sendLatest(p.TalkbackChan, p.talkback.track)
+	return p.talkback, nil
+}
+
+// EndTalkback stops the operator talking to the channel's publisher, if they are
+func (r *Registry) EndTalkback(channelName string, operatorID string) {
+	r.Lock()
+	defer r.Unlock()
+	channel, ok := r.channels[channelName]
+	if !ok {
+		return
+	}
+	for _, p := range []*Publisher{channel.Publisher, channel.Standby} {
+		if p != nil && p.talkbackID == operatorID {
+			p.talkbackID = ""
+			p.talkback.setSource("")
+			sendLatest(p.TalkbackChan, nil)
+		}
+	}
+}
+
+// moveTalkback moves the operator talking to a publisher that is going off air, if any, to
+// the publisher taking over. The talkback writer moves with them, so the operator's audio
+// stays one continuous stream. If the new publisher can't take it, talkback ends
+func moveTalkback(from *Publisher, to *Publisher) {
+	if from.talkbackID == "" {
+		return
+	}
+	sendLatest(from.TalkbackChan, nil)
+	if !to.acceptsTalkback || (to.talkback != nil && to.talkback != from.talkback) {
+		from.talkback.setSource("")
+		from.talkbackID = ""
+		return
+	}
+	to.talkback = from.talkback
+	to.talkbackID = from.talkbackID
+	from.talkbackID = ""
+	sendLatest(to.TalkbackChan, to.talkback.track)
+}
+
+// connectTalkback connects an operator's audio to a channel's publisher. Operators need the admin
+// password. An operator already talking to a publisher stops, and talks to the new channel's instead
+func (c *Conn) connectTalkback(cmd CmdConnect) error {
+	if adminPassword == "" {
+		return fmt.Errorf("talkback is disabled, set an admin password to enable it")
+	}
+	if !hmac.Equal([]byte(cmd.Password), []byte(adminPassword)) {
+		return errIncorrectPassword
+	}
+	if err := checkChannelName(cmd.Channel); err != nil {
+		return err
+	}
+	if c.peer.pc == nil {
+		return fmt.Errorf("webrtc session not established")
+	}
+	// the track is only sent once, so it is kept for the operator to move to another channel
+	c.Lock()
+	track := c.talkbackTrack
+	if c.talkback != nil {
+		reg.EndTalkback(c.channelName, c.clientID)
+		c.talkback = nil
+	}
+	c.Unlock()
+	if track == nil {
+		select {
+		case track = <-c.peer.localTrackChan:
+		case <-c.quitchan:
+			return fmt.Errorf("connection closed before talkback track was received")
+		}
+		c.Lock()
+		c.talkbackTrack = track
+		c.Unlock()
+	}
+
+	id := uuid.NewString()
+	tw, err := reg.StartTalkback(cmd.Channel, id, track)
+	if err != nil {
+		return err
+	}
+	c.Lock()
+	c.channelName = cmd.Channel
+	c.clientID = id
+	c.talkback = tw
+	c.Unlock()
+	c.logger.Info("operator talking to publisher", "channel", cmd.Channel)
+	j, _ := json.Marshal(cmd.Channel)
+	return c.writeMsg(wsMsg{Key: "talkback_started", Value: j})
+}
+
+// WebRTC callback function
+func (c *Conn) rtcTrackHandlerTalkback(remoteTrack *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+	// the stream ID tells the publisher's client this is talkback, not their source channel
+	localTrack, err := webrtc.NewTrackLocalStaticRTP(remoteTrack.Codec().RTPCodecCapability, "audio", "talkback")
+	if err != nil {
+		c.logger.Error("talkback track error", "err", err)
+		return
+	}
+	select {
+	case c.peer.localTrackChan <- localTrack:
+	case <-c.quitchan:
+		return
+	}
+
+	for {
+		pkt, _, readErr := remoteTrack.ReadRTP()
+		if readErr != nil {
+			if !errors.Is(readErr, io.EOF) {
+				c.logger.Error("remoteTrack.Read error", "err", readErr)
+			}
+			return
+		}
+		c.Lock()
+		tw, id := c.talkback, c.clientID
+		c.Unlock()
+		if tw == nil {
+			// not talking to a publisher yet
+			continue
+		}
+		// ErrClosedPipe means the publisher hasn't bound the track yet
+		if err := tw.writeRTP(id, pkt); err != nil && !errors.Is(err, io.ErrClosedPipe) {
+			c.logger.Error("talkback write error", "err", err)
+		}
+	}
+}
+
+// talkbackChan returns the channel on which talkback is received, or nil if the connection is not (yet) a publisher
+func (c *Conn) talkbackChan() chan *webrtc.TrackLocalStaticRTP {
+	if c.publisher == nil {
+		return nil
+	}
+	return c.publisher.TalkbackChan
+}
+
+// setTalkback sends the talkback track to the publisher, or stops sending if nil. The first
+// talkback adds a sendonly transceiver and renegotiates; later ones reuse it with ReplaceTrack
+func (c *Conn) setTalkback(track *webrtc.TrackLocalStaticRTP) error {
+	switch {
+	case c.talkbackSender == nil && track != nil:
+		transceiver, err := c.peer.pc.AddTransceiverFromTrack(track, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionSendonly})
+		if err != nil {
+			return err
+		}
+		c.talkbackSender = transceiver.Sender()
+		go readRTCP(c.talkbackSender)
+		if err := c.renegotiate(); err != nil {
+			return err
+		}
+	case c.talkbackSender != nil && track != nil:
+		if err := c.talkbackSender.ReplaceTrack(track); err != nil {
+			return err
+		}
+	case c.talkbackSender != nil:
+		if err := c.talkbackSender.ReplaceTrack(nil); err != nil {
+			return err
+		}
+	}
+	if track != nil {
+		c.logger.Info("talkback started", "channel", c.channelName)
+	} else {
+		c.logger.Info("talkback ended", "channel", c.channelName)
+	}
+	j, _ := json.Marshal(track != nil)
+	return c.writeMsg(wsMsg{Key: "talkback", Value: j})
+}
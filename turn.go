@@ -0,0 +1,140 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+
+	"github.com/pion/turn/v4"
+)
+
+const turnRealm = "babelcast"
+
+// StartTURNServer starts a built-in TURN/STUN server on the given UDP and TCP port, relaying
+// via relayIP. If relayIP is empty, the first non-loopback IPv4 address is used.
+// Credentials are generated for each session from a random secret, and the server is added
+// to the ICE servers used by peers and sent to clients. Only Babelcast's own addresses, the
+// relay IP, the public IPs and the local addresses ICE may use, can be relayed to, so the
+// server can't be used as an open relay
+func StartTURNServer(port int, relayIP string, nc NetworkConfig) (*turn.Server, error) {
+	if relayIP == "" {
+		var err error
+		if relayIP, err = defaultRelayIP(); err != nil {
+			return nil, err
+		}
+	}
+	ip := net.ParseIP(relayIP)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid TURN relay IP %q", relayIP)
+	}
+
+	allowed, err := nc.localIPs()
+	if err != nil {
+		return nil, err
+	}
+	allowed = append(allowed, ip)
+	for _, entry := range nc.PublicIPs {
+		// either an IP or a public/local pair
+		for _, s := range strings.Split(entry, "/") {
+			if peerIP := net.ParseIP(s); peerIP != nil {
+				allowed = append(allowed, peerIP)
+			}
+		}
+	}
+	permission := func(clientAddr net.Addr, peerIP net.IP) bool {
+		for _, a := range allowed {
+			if a.Equal(peerIP) {
+				return true
+			}
+		}
+		slog.Warn("TURN permission denied", "client", clientAddr, "peer", peerIP)
+		return false
+	}
+
+	secretBytes := make([]byte, 32)
+	if _, err := rand.Read(secretBytes); err != nil {
+		return nil, err
+	}
+	secret := hex.EncodeToString(secretBytes)
+
+	addr := fmt.Sprintf(":%d", port)
+	udpListener, err := net.ListenPacket("udp4", addr)
+	if err != nil {
+		return nil, err
+	}
+	tcpListener, err := net.Listen("tcp4", addr)
+	if err != nil {
+		udpListener.Close()
+		return nil, err
+	}
+
+	relayGen := &turn.RelayAddressGeneratorStatic{RelayAddress: ip, Address: "0.0.0.0"}
+	server, err := turn.NewServer(turn.ServerConfig{
+		Realm:       turnRealm,
+		AuthHandler: turn.LongTermTURNRESTAuthHandler(secret, nil),
+		PacketConnConfigs: []turn.PacketConnConfig{
+			{PacketConn: udpListener, RelayAddressGenerator: relayGen, PermissionHandler: permission},
+		},
+		ListenerConfigs: []turn.ListenerConfig{
+			{Listener: tcpListener, RelayAddressGenerator: relayGen, PermissionHandler: permission},
+		},
+	})
+	if err != nil {
+		udpListener.Close()
+		tcpListener.Close()
+		return nil, err
+	}
+
+	hostPort := net.JoinHostPort(ip.String(), fmt.Sprint(port))
+	iceServerConfigs = append(iceServerConfigs, &ICEServerConfig{
+		URLs: []string{
+			"stun:" + hostPort,
+			"turn:" + hostPort + "?transport=udp",
+			"turn:" + hostPort + "?transport=tcp",
+		},
+		Secret: secret,
+		ttl:    defaultTURNCredentialTTL,
+	})
+
+	return server, nil
+}
+
+// defaultRelayIP returns the first non-loopback IPv4 address of an interface that is up
+func defaultRelayIP() (string, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return "", err
+	}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			if ipNet, ok := a.(*net.IPNet); ok && ipNet.IP.To4() != nil {
+				return ipNet.IP.String(), nil
+			}
+		}
+	}
+	return "", fmt.Errorf("no IPv4 address found for TURN relay, set it explicitly")
+}
@@ -16,8 +16,11 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"io"
 	"log/slog"
+	"sync"
+	"time"
 
 	"github.com/pion/webrtc/v4"
 )
@@ -25,34 +28,75 @@ import (
 type WebRTCPeer struct {
 	pc             *webrtc.PeerConnection
 	localTrackChan chan *webrtc.TrackLocalStaticRTP
+	publisherChan  chan *Publisher
+
+	// sourceSender sends a publisher the channel they are listening to, see listenSource. It
+	// is nil if the publisher can't receive audio. sourcePlaceholder is sent in the meantime,
+	// nothing is ever written to it
+	sourceSender      *webrtc.RTPSender
+	sourcePlaceholder *webrtc.TrackLocalStaticRTP
+
+	// subscriberSender sends a subscriber their channel. Its track is replaced when they switch channels
+	subscriberSender *webrtc.RTPSender
+
+	// publisherTransceiver receives a publisher's audio
+	publisherTransceiver *webrtc.RTPTransceiver
+
+	negotiationMu sync.Mutex
+	// negotiationNeeded is set when the server changes the session while an offer awaits an answer
+	negotiationNeeded bool
 }
 
-func NewWebRTCPeer() (*WebRTCPeer, error) {
+func NewWebRTCPeer(iceServers []webrtc.ICEServer) (*WebRTCPeer, error) {
 
 	var err error
 	wp := &WebRTCPeer{}
 	// Create a new RTCPeerConnection
-	wp.pc, err = webrtc.NewPeerConnection(webrtc.Configuration{
-		ICEServers: []webrtc.ICEServer{
-			{
-				URLs: []string{"stun:stun.l.google.com:19302"},
-			},
-		},
+	wp.pc, err = webrtcAPI.NewPeerConnection(webrtc.Configuration{
+		ICEServers: iceServers,
 	})
 	if err != nil {
 		return nil, err
 	}
 	wp.localTrackChan = make(chan *webrtc.TrackLocalStaticRTP)
+	wp.publisherChan = make(chan *Publisher)
 
 	return wp, nil
 }
 
-func (wp *WebRTCPeer) SetupPublisher(offer webrtc.SessionDescription, onStateChange func(connectionState webrtc.ICEConnectionState), onTrack func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver), onIceCandidate func(c *webrtc.ICECandidate)) (answer webrtc.SessionDescription, err error) {
+// SetupPublisher answers a publisher's offer, allowing only the given codecs
+func (wp *WebRTCPeer) SetupPublisher(offer webrtc.SessionDescription, codecs []webrtc.RTPCodecParameters, onStateChange func(connectionState webrtc.ICEConnectionState), onTrack func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver), onIceCandidate func(c *webrtc.ICECandidate)) (answer webrtc.SessionDescription, err error) {
 
-	// Allow us to receive 1 audio track
-	if _, err = wp.pc.AddTransceiverFromKind(webrtc.RTPCodecTypeAudio); err != nil {
+	if err = checkOfferCodecs(&offer, codecs); err != nil {
+		return
+	}
+
+	// Allow us to receive 1 audio track. Publishers that can also receive Opus may listen
+	// to another channel on the same transceiver, see listenSource
+	var transceiver *webrtc.RTPTransceiver
+	if canListenSource(&offer) {
+		wp.sourcePlaceholder, err = webrtc.NewTrackLocalStaticRTP(codecs[0].RTPCodecCapability, "audio", "babelcast")
+		if err != nil {
+			return
+		}
+		transceiver, err = wp.pc.AddTransceiverFromTrack(wp.sourcePlaceholder, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionSendrecv})
+		if err != nil {
+			return
+		}
+		wp.sourceSender = transceiver.Sender()
+		go readRTCP(wp.sourceSender)
+	} else {
+		transceiver, err = wp.pc.AddTransceiverFromKind(webrtc.RTPCodecTypeAudio, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly})
+		if err != nil {
+			return
+		}
+	}
+	// answer with our own codec parameters, rather than echoing the publisher's,
+	// and only with the codecs publishers are allowed to use
+	if err = transceiver.SetCodecPreferences(codecs); err != nil {
 		return
 	}
+	wp.publisherTransceiver = transceiver
 
 	wp.pc.OnICEConnectionStateChange(onStateChange)
 	wp.pc.OnTrack(onTrack)
@@ -77,31 +121,33 @@ func (wp *WebRTCPeer) SetupPublisher(offer webrtc.SessionDescription, onStateCha
 	return
 }
 
+// SetPublisherCodecs changes the codec parameters sent to a publisher. They take effect
+// when the session is next renegotiated
+func (wp *WebRTCPeer) SetPublisherCodecs(codecs []webrtc.RTPCodecParameters) error {
+	if wp.publisherTransceiver == nil {
+		return fmt.Errorf("webrtc session not established")
+	}
+	return wp.publisherTransceiver.SetCodecPreferences(codecs)
+}
+
 // SetupSubscriber completes the subscriber WebRTC session setup.
 // Earlier we called webrtc.SetRemoteDescription() to allow ICE to kick off
 func (wp *WebRTCPeer) SetupSubscriber(channel *Channel, onStateChange func(connectionState webrtc.ICEConnectionState), onIceCandidate func(c *webrtc.ICECandidate)) (answer webrtc.SessionDescription, err error) {
 
+	// the subscriber must support the codec the publisher is sending
+	if err = checkOfferCodecs(wp.pc.RemoteDescription(), []webrtc.RTPCodecParameters{{RTPCodecCapability: channel.Codec}}); err != nil {
+		err = fmt.Errorf("channel uses codec %s, which this client doesn't support: %w", channel.Codec.MimeType, err)
+		return
+	}
+
 	rtpSender, addTrackErr := wp.pc.AddTrack(channel.LocalTrack)
 	if addTrackErr != nil {
 		err = addTrackErr
 		return
 	}
+	wp.subscriberSender = rtpSender
 
-	// Read incoming RTCP packets
-	// Before these packets are returned they are processed by interceptors. For things
-	// like NACK this needs to be called.
-	go func() {
-		rtcpBuf := make([]byte, 1500)
-		for {
-			_, _, rtcpErr := rtpSender.Read(rtcpBuf)
-			if rtcpErr != nil {
-				if !errors.Is(rtcpErr, io.EOF) {
-					slog.Error("rtpSender.Read error", "err", rtcpErr)
-				}
-				return
-			}
-		}
-	}()
+	go readRTCP(rtpSender)
 
 	wp.pc.OnICEConnectionStateChange(onStateChange)
 	wp.pc.OnICECandidate(onIceCandidate)
@@ -120,3 +166,144 @@ func (wp *WebRTCPeer) SetupSubscriber(channel *Channel, onStateChange func(conne
 
 	return
 }
+
+// Either side may renegotiate an established session, e.g. to add a track or restart ICE.
+// If both offer at once, the server's offer wins: the client must roll its own back, answer
+// the server's and offer again
+
+// Renegotiate returns a new offer after the server has changed the session. If an offer is
+// already awaiting an answer it returns nil, and SetAnswer returns the new offer instead
+func (wp *WebRTCPeer) Renegotiate() (*webrtc.SessionDescription, error) {
+	wp.negotiationMu.Lock()
+	defer wp.negotiationMu.Unlock()
+	if wp.pc.SignalingState() != webrtc.SignalingStateStable {
+		wp.negotiationNeeded = true
+		return nil, nil
+	}
+	return wp.offer()
+}
+
+// SetAnswer applies the client's answer to our offer. If the session changed while the offer
+// was outstanding, the next offer is returned. If the answer can't be applied, the offer
+// still awaiting an answer is returned along with the error, to be sent again
+func (wp *WebRTCPeer) SetAnswer(sdp string) (*webrtc.SessionDescription, error) {
+	wp.negotiationMu.Lock()
+	defer wp.negotiationMu.Unlock()
+	if wp.pc.SignalingState() != webrtc.SignalingStateHaveLocalOffer {
+		return nil, fmt.Errorf("no offer awaiting an answer")
+	}
+	if err := wp.pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: sdp}); err != nil {
+		wp.rollback()
+		if wp.pc.SignalingState() == webrtc.SignalingStateHaveLocalOffer {
+			return wp.pc.PendingLocalDescription(), err
+		}
+		return nil, err
+	}
+	if !wp.negotiationNeeded {
+		return nil, nil
+	}
+	return wp.offer()
+}
+
+// AnswerOffer answers the client's offer to renegotiate. If it collides with an offer of ours
+// the client's is ignored and nil is returned
+func (wp *WebRTCPeer) AnswerOffer(sdp string) (*webrtc.SessionDescription, error) {
+	wp.negotiationMu.Lock()
+	defer wp.negotiationMu.Unlock()
+	if wp.pc.RemoteDescription() == nil {
+		return nil, fmt.Errorf("webrtc session not established")
+	}
+	if wp.pc.SignalingState() == webrtc.SignalingStateHaveLocalOffer {
+		return nil, nil
+	}
+	offer := webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: sdp}
+	// pion applies an offer in steps, and can't undo the first if a later one fails, so
+	// check what we can beforehand
+	parsed, err := offer.Unmarshal()
+	if err != nil {
+		return nil, err
+	}
+	for _, md := range parsed.MediaDescriptions {
+		if _, ok := md.Attribute("mid"); !ok {
+			return nil, fmt.Errorf("offer has a media section without a mid")
+		}
+	}
+	if err := wp.pc.SetRemoteDescription(offer); err != nil {
+		wp.rollback()
+		return nil, err
+	}
+	answer, err := wp.pc.CreateAnswer(nil)
+	if err != nil {
+		wp.rollback()
+		return nil, err
+	}
+	if err = wp.pc.SetLocalDescription(answer); err != nil {
+		wp.rollback()
+		return nil, err
+	}
+	return &answer, nil
+}
+
+// rollback undoes a failed renegotiation, so that the session can be renegotiated again.
+// pion doesn't support rolling back from have-local-offer or have-remote-offer yet, so
+// if that fails, a client offer that was only partly applied is answered locally instead.
+// An offer of ours is left in place for SetAnswer to send again. negotiationMu must be held
+func (wp *WebRTCPeer) rollback() {
+	state := wp.pc.SignalingState()
+	if state == webrtc.SignalingStateStable {
+		return
+	}
+	if err := wp.pc.SetLocalDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeRollback}); err == nil {
+		return
+	}
+	if state == webrtc.SignalingStateHaveRemoteOffer {
+		answer, err := wp.pc.CreateAnswer(nil)
+		if err == nil {
+			err = wp.pc.SetLocalDescription(answer)
+		}
+		if err != nil {
+			slog.Error("renegotiation rollback error", "err", err)
+		}
+	}
+}
+
+// offer creates and sets a new local offer. negotiationMu must be held
+func (wp *WebRTCPeer) offer() (*webrtc.SessionDescription, error) {
+	wp.negotiationNeeded = false
+	offer, err := wp.pc.CreateOffer(nil)
+	if err != nil {
+		return nil, err
+	}
+	if err = wp.pc.SetLocalDescription(offer); err != nil {
+		return nil, err
+	}
+	return &offer, nil
+}
+
+// readRTCP reads incoming RTCP packets until the sender is stopped.
+// Before these packets are returned they are processed by interceptors. For things
+// like NACK this needs to be called.
+func readRTCP(rtpSender *webrtc.RTPSender) {
+	rtcpBuf := make([]byte, 1500)
+	for {
+		_, _, rtcpErr := rtpSender.Read(rtcpBuf)
+		if rtcpErr != nil {
+			if !errors.Is(rtcpErr, io.EOF) {
+				slog.Error("rtpSender.Read error", "err", rtcpErr)
+			}
+			return
+		}
+	}
+}
+
+// gatheredLocalDescription waits for ICE candidate gathering to complete and returns the
+// local description with all candidates included. This is used by signaling methods
+// that don't support trickle ICE (WHIP/WHEP)
+func (wp *WebRTCPeer) gatheredLocalDescription() (*webrtc.SessionDescription, error) {
+	select {
+	case <-webrtc.GatheringCompletePromise(wp.pc):
+	case <-time.After(gatherTimeout):
+		return nil, fmt.Errorf("timed out gathering ICE candidates")
+	}
+	return wp.pc.LocalDescription(), nil
+}
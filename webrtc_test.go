@@ -0,0 +1,138 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// testSession returns a server peer and a client connection with an established session
+func testSession(t *testing.T) (*WebRTCPeer, *webrtc.PeerConnection) {
+	t.Helper()
+	wp, err := NewWebRTCPeer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		wp.pc.Close()
+		client.Close()
+	})
+	if _, err := client.AddTransceiverFromKind(webrtc.RTPCodecTypeAudio); err != nil {
+		t.Fatal(err)
+	}
+	offer, err := client.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.SetLocalDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+	if err := wp.pc.SetRemoteDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+	answer, err := wp.pc.CreateAnswer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := wp.pc.SetLocalDescription(answer); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.SetRemoteDescription(answer); err != nil {
+		t.Fatal(err)
+	}
+	return wp, client
+}
+
+// answerOffer answers a server offer as the client would
+func answerOffer(t *testing.T, client *webrtc.PeerConnection, offer *webrtc.SessionDescription) string {
+	t.Helper()
+	if err := client.SetRemoteDescription(*offer); err != nil {
+		t.Fatal(err)
+	}
+	answer, err := client.CreateAnswer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.SetLocalDescription(answer); err != nil {
+		t.Fatal(err)
+	}
+	return answer.SDP
+}
+
+func TestRenegotiateAfterBadAnswer(t *testing.T) {
+	wp, client := testSession(t)
+
+	if _, err := wp.pc.AddTransceiverFromKind(webrtc.RTPCodecTypeAudio); err != nil {
+		t.Fatal(err)
+	}
+	offer, err := wp.Renegotiate()
+	if err != nil || offer == nil {
+		t.Fatalf("renegotiate: %v", err)
+	}
+	resend, err := wp.SetAnswer("bogus")
+	if err == nil {
+		t.Fatal("expected an error for a bad answer")
+	}
+	if resend == nil || resend.SDP != offer.SDP {
+		t.Fatal("the offer awaiting an answer was not returned to send again")
+	}
+
+	// the client answers the offer sent again, and the session can be renegotiated afterwards
+	if _, err := wp.SetAnswer(answerOffer(t, client, resend)); err != nil {
+		t.Fatalf("set answer: %s", err)
+	}
+	if _, err := wp.pc.AddTransceiverFromKind(webrtc.RTPCodecTypeAudio); err != nil {
+		t.Fatal(err)
+	}
+	offer, err = wp.Renegotiate()
+	if err != nil || offer == nil {
+		t.Fatalf("renegotiate after a bad answer: %v", err)
+	}
+	if _, err := wp.SetAnswer(answerOffer(t, client, offer)); err != nil {
+		t.Fatalf("set answer: %s", err)
+	}
+}
+
+func TestRenegotiateAfterBadOffer(t *testing.T) {
+	wp, client := testSession(t)
+
+	// an offer without mids would fail part way through being applied, so is rejected beforehand
+	if _, err := client.AddTransceiverFromKind(webrtc.RTPCodecTypeAudio); err != nil {
+		t.Fatal(err)
+	}
+	offer, err := client.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bad := regexp.MustCompile(`a=mid:.*\r\n`).ReplaceAllString(offer.SDP, "")
+	if _, err := wp.AnswerOffer(bad); err == nil {
+		t.Fatal("expected an error for a bad offer")
+	}
+	if state := wp.pc.SignalingState(); state != webrtc.SignalingStateStable {
+		t.Fatalf("signaling state = %s after a bad offer, want stable", state)
+	}
+
+	offer2, err := wp.Renegotiate()
+	if err != nil || offer2 == nil {
+		t.Fatalf("renegotiate after a bad offer: %v", err)
+	}
+}
@@ -0,0 +1,140 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+
+	"github.com/google/uuid"
+	"github.com/pion/webrtc/v4"
+)
+
+var whepSessions = &httpSessions{conns: make(map[string]*Conn)}
+
+// whepHandler accepts an SDP offer from a WHEP client (e.g. a hardware player) and
+// sets up a subscriber on the channel given in the URL path
+func whepHandler(w http.ResponseWriter, r *http.Request) {
+	channelName := r.PathValue("channel")
+	if err := checkChannelName(channelName); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if token := bearerToken(r); channelConfigs.CheckListener(channelName, token, token) != nil {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, errListenerAuth.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	channel := reg.GetChannel(channelName)
+	if channel == nil {
+		http.Error(w, fmt.Sprintf("channel %q not found", channelName), http.StatusNotFound)
+		return
+	}
+
+	offer, err := readSDPOffer(w, r)
+	if err != nil {
+		return
+	}
+
+	c := newConn(clientAddress(r))
+	c.channelName = channelName
+	iceServers := ICEServers(uuid.NewString())
+	c.peer, err = NewWebRTCPeer(iceServers)
+	if err != nil {
+		c.logger.Error("NewWebRTCPeer error", "err", err.Error())
+		http.Error(w, "error creating peer connection", http.StatusInternalServerError)
+		return
+	}
+
+	c.logger.Info("WHEP client connected")
+
+	if err := c.peer.pc.SetRemoteDescription(offer); err != nil {
+		c.logger.Error("SetRemoteDescription error", "err", err)
+		c.Close()
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// WHEP clients are not sent trickled candidates, the answer will contain them all
+	noTrickle := func(*webrtc.ICECandidate) {}
+	if _, err := c.peer.SetupSubscriber(channel, c.rtcStateChangeHandler, noTrickle); err != nil {
+		c.logger.Error("SetupSubscriber error", "err", err)
+		c.Close()
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	answer, err := c.peer.gatheredLocalDescription()
+	if err != nil {
+		c.logger.Error("ICE gathering error", "err", err)
+		c.Close()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	c.logger.Info("setting up subscriber for channel", "channel", c.channelName)
+
+	s := reg.NewSubscriber(c.addr)
+	c.Lock()
+	c.clientID = s.ID
+	c.Unlock()
+	if err := reg.AddSubscriber(c.channelName, s); err != nil {
+		c.Close()
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	reg.SetICEState(c.channelName, s.ID, c.peer.pc.ICEConnectionState())
+
+	whepSessions.add(c.channelName, s.ID, c)
+
+	go func() {
+		defer whepSessions.remove(c.channelName, s.ID)
+		defer c.Close()
+		go func() {
+			select {
+			case <-c.quitchan:
+			case <-s.QuitChan:
+				c.logger.Info("channel closed, ending WHEP session", "channel", c.channelName)
+				c.quit()
+			}
+		}()
+		c.runHTTPSession()
+	}()
+
+	for _, link := range iceServerLinks(iceServers) {
+		w.Header().Add("Link", link)
+	}
+	w.Header().Set("Content-Type", "application/sdp")
+	w.Header().Set("Location", fmt.Sprintf("/whep/%s/%s", url.PathEscape(c.channelName), s.ID))
+	w.WriteHeader(http.StatusCreated)
+	io.WriteString(w, answer.SDP)
+}
+
+// whepDeleteHandler tears down a WHEP session
+func whepDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	c := whepSessions.get(r.PathValue("channel"), r.PathValue("id"))
+	if c == nil {
+		http.Error(w, "session not found", http.StatusNotFound)
+		return
+	}
+
+	c.logger.Info("WHEP session deleted by client")
+	c.quit()
+	w.WriteHeader(http.StatusOK)
+}
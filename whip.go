@@ -0,0 +1,246 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pion/webrtc/v4"
+)
+
+// maximum size of an SDP offer we will accept over HTTP
+const maxSDPSize = 64 * 1024
+
+// how long to wait for ICE candidate gathering before answering a WHIP/WHEP offer
+const gatherTimeout = 5 * time.Second
+
+// httpSessions keeps track of WebRTC sessions established over HTTP (WHIP/WHEP),
+// so that they can later be torn down by a DELETE request on the session resource.
+// Sessions are keyed by channel name and session ID
+type httpSessions struct {
+	sync.Mutex
+	conns map[string]*Conn
+}
+
+var whipSessions = &httpSessions{conns: make(map[string]*Conn)}
+
+func (s *httpSessions) add(channelName string, id string, c *Conn) {
+	s.Lock()
+	defer s.Unlock()
+	s.conns[channelName+"/"+id] = c
+}
+
+func (s *httpSessions) get(channelName string, id string) *Conn {
+	s.Lock()
+	defer s.Unlock()
+	return s.conns[channelName+"/"+id]
+}
+
+func (s *httpSessions) remove(channelName string, id string) {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.conns, channelName+"/"+id)
+}
+
+// whipHandler accepts an SDP offer from a WHIP client (e.g. OBS, GStreamer) and
+// sets up a publisher on the channel given in the URL path
+func whipHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	cmd := CmdConnect{
+		Channel:     r.PathValue("channel"),
+		Password:    bearerToken(r),
+		Standby:     query.Has("standby"),
+		ResumeToken: query.Get("resume_token"),
+		ChannelMeta: ChannelMeta{
+			Language:    query.Get("language"),
+			Title:       query.Get("title"),
+			Description: query.Get("description"),
+		},
+	}
+	if weight := query.Get("weight"); weight != "" {
+		var err error
+		if cmd.Weight, err = strconv.Atoi(weight); err != nil {
+			http.Error(w, "weight must be an integer", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if err := checkPublisher(cmd); err != nil {
+		if errors.Is(err, errIncorrectPassword) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := reg.CheckPublisherAvailable(cmd.Channel, cmd.ResumeToken, cmd.Standby); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	offer, err := readSDPOffer(w, r)
+	if err != nil {
+		return
+	}
+
+	c := newConn(clientAddress(r))
+	c.isPublisher = true
+	// a resuming publisher keeps its token, anyone else is issued a new one
+	c.resumeToken = cmd.ResumeToken
+	if c.resumeToken == "" || cmd.Standby {
+		c.resumeToken = uuid.NewString()
+	}
+	iceServers := ICEServers(uuid.NewString())
+	c.peer, err = NewWebRTCPeer(iceServers)
+	if err != nil {
+		c.logger.Error("NewWebRTCPeer error", "err", err.Error())
+		http.Error(w, "error creating peer connection", http.StatusInternalServerError)
+		return
+	}
+
+	c.logger.Info("WHIP client connected")
+
+	// WHIP clients are not sent trickled candidates, the answer will contain them all
+	noTrickle := func(*webrtc.ICECandidate) {}
+	if _, err := c.peer.SetupPublisher(offer, channelConfigs.PublisherCodecs(cmd.Channel), c.rtcStateChangeHandler, c.rtcTrackHandlerPublisher, noTrickle); err != nil {
+		c.logger.Error("SetupPublisher error", "err", err)
+		c.Close()
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	answer, err := c.peer.gatheredLocalDescription()
+	if err != nil {
+		c.logger.Error("ICE gathering error", "err", err)
+		c.Close()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	id := uuid.NewString()
+	whipSessions.add(cmd.Channel, id, c)
+
+	go func() {
+		defer whipSessions.remove(cmd.Channel, id)
+		defer c.Close()
+		connectDone := make(chan struct{})
+		go func() {
+			defer close(connectDone)
+			if _, err := c.connectPublisher(cmd); err != nil {
+				c.logger.Error("connectPublisher error", "err", err)
+				c.quit()
+			}
+		}()
+		c.runHTTPSession()
+		// connectPublisher returns promptly once quit, wait for it so that
+		// Close sees the registered publisher
+		<-connectDone
+	}()
+
+	for _, link := range iceServerLinks(iceServers) {
+		w.Header().Add("Link", link)
+	}
+	w.Header().Set("Content-Type", "application/sdp")
+	w.Header().Set("Babelcast-Resume-Token", c.resumeToken)
+	w.Header().Set("Location", fmt.Sprintf("/whip/%s/%s", url.PathEscape(cmd.Channel), id))
+	w.WriteHeader(http.StatusCreated)
+	io.WriteString(w, answer.SDP)
+}
+
+// whipDeleteHandler tears down a WHIP session
+func whipDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	channelName := r.PathValue("channel")
+	c := whipSessions.get(channelName, r.PathValue("id"))
+	if c == nil {
+		http.Error(w, "session not found", http.StatusNotFound)
+		return
+	}
+
+	if err := checkPublisher(CmdConnect{Channel: channelName, Password: bearerToken(r)}); err != nil {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	c.logger.Info("WHIP session deleted by client")
+	c.quit()
+	w.WriteHeader(http.StatusOK)
+}
+
+// runHTTPSession plays the role of the websocket handler loop for sessions
+// that have no websocket: info messages are logged and the loop returns when the
+// connection quits
+func (c *Conn) runHTTPSession() {
+	for {
+		select {
+		case info := <-c.infoChan:
+			c.logger.Debug("session info", "info", info)
+		case <-c.quitchan:
+			c.logger.Debug("quitChan closed")
+			return
+		}
+	}
+}
+
+// readSDPOffer reads an SDP offer from the request body. On error, an HTTP error response
+// has already been written
+func readSDPOffer(w http.ResponseWriter, r *http.Request) (offer webrtc.SessionDescription, err error) {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "application/sdp" {
+		err = fmt.Errorf("content type must be application/sdp")
+		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxSDPSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	offer = webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: string(body)}
+	return
+}
+
+// bearerToken returns the token from the request's Authorization header, if any
+func bearerToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	token, ok := strings.CutPrefix(auth, "Bearer ")
+	if !ok {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+func clientAddress(r *http.Request) string {
+	addr := r.RemoteAddr
+	xFwdIP := r.Header.Get("X-Forwarded-For")
+	if xFwdIP != "" {
+		addr += " (" + xFwdIP + ")"
+	}
+	return addr
+}